@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	enableAdmin  bool
+	shutdownCh   = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// requestShutdown asks main to stop accepting connections and drain,
+// exactly as a SIGTERM would. Calls after the first are no-ops.
+func requestShutdown() {
+	shutdownOnce.Do(func() {
+		close(shutdownCh)
+	})
+}
+
+// handleAdminShutdown answers 200 and starts a graceful shutdown. The
+// response still goes out since in-flight requests are drained.
+func handleAdminShutdown(req request, res *response) {
+	fmt.Println("Shutdown requested via /admin/shutdown")
+	responseContent(res, []byte("shutting down"), TypeTextPlain)
+	requestShutdown()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+const authRealm = "files"
+
+var (
+	authUser string
+	authPass string
+)
+
+// requireAuth wraps h so that it only runs for requests carrying Basic
+// credentials matching -auth-user and -auth-pass. Without configured
+// credentials h is returned unchanged.
+func requireAuth(h HandlerFunc) HandlerFunc {
+	return func(req request, res *response) {
+		if authUser == "" && authPass == "" {
+			h(req, res)
+			return
+		}
+		if !validCredentials(req.Header("Authorization")) {
+			res.statusCode = ResponseUnauthorized
+			res.SetHeader("WWW-Authenticate", `Basic realm="`+authRealm+`"`)
+			return
+		}
+		h(req, res)
+	}
+}
+
+func validCredentials(authorization string) bool {
+	scheme, encoded, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(authUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(authPass)) == 1
+	return userOK && passOK
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"io/fs"
+	"sync"
+)
+
+var (
+	cacheSize int64
+	cache     *fileCache
+)
+
+// cacheKey names one representation of a file: its plain content
+// when encoding is empty, and otherwise its content in that encoding.
+type cacheKey struct {
+	path     string
+	encoding string
+}
+
+// cacheEntry is a representation of a file while the file had etag,
+// which changes with the modification time and size.
+type cacheEntry struct {
+	key     cacheKey
+	content []byte
+	etag    string
+}
+
+// fileCache keeps the most recently served files in memory up to a
+// total of budget content bytes, evicting the least recently used
+// ones first. Entries are checked against the current ETag of the file
+// on every lookup, and writes through the file handlers invalidate them.
+// The plain and gzip representations of a file are cached separately,
+// so clients accepting gzip are served from memory too.
+type fileCache struct {
+	mu      sync.Mutex
+	budget  int64
+	used    int64
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+}
+
+func newFileCache(budget int64) *fileCache {
+	return &fileCache{budget: budget, lru: list.New(), entries: make(map[cacheKey]*list.Element)}
+}
+
+// get returns the cached content of path in encoding if it is still
+// current for info. A stale entry is dropped.
+func (c *fileCache) get(path string, encoding string, info fs.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey{path, encoding}]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.etag != fileETag(info) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.content, true
+}
+
+// put stores the content of path in encoding, produced while the file
+// had info. Content larger than the whole budget is not cached.
+func (c *fileCache) put(path string, encoding string, info fs.FileInfo, content []byte) {
+	size := int64(len(content))
+	if size > c.budget {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{path, encoding}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	for c.used+size > c.budget {
+		c.remove(c.lru.Back())
+	}
+	entry := &cacheEntry{key: key, content: content, etag: fileETag(info)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.used += size
+}
+
+// invalidate drops every representation of path from the cache.
+func (c *fileCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, encoding := range []string{"", EncodingGzip} {
+		if el, ok := c.entries[cacheKey{path, encoding}]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *fileCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= int64(len(entry.content))
+}
+
+// invalidateCache drops path from the file cache, if one is in use.
+func invalidateCache(path string) {
+	if cache != nil {
+		cache.invalidate(path)
+	}
+}
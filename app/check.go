@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var checkOnly bool
+
+// runChecks validates the configuration the way serving would use it,
+// printing one line per check, and returns the process exit code.
+func runChecks() int {
+	failed, total := 0, 0
+	check := func(name string, err error) {
+		total++
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err.Error())
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	if directory != "" {
+		check("directory "+directory, checkDir(directory))
+	}
+	if indexFile != "" {
+		check("index "+indexFile, checkIndex())
+	}
+	for host, dir := range vhosts {
+		check("vhost "+host+" directory "+dir, checkDir(dir))
+	}
+	for _, m := range mounts {
+		check("mount "+m.prefix+" directory "+m.root, checkDir(m.root))
+	}
+	for flag, name := range map[string]string{"notfound-file": notFound, "favicon": favicon} {
+		if name != "" {
+			check(flag+" "+name, checkFile(name))
+		}
+	}
+	if tlsCert != "" || tlsKey != "" {
+		check("TLS certificate and key", checkTLS())
+	}
+	ports := strings.Split(port, ",")
+	if protocol == "unix" {
+		ports = ports[:1]
+	}
+	for _, p := range ports {
+		p = strings.TrimSpace(p)
+		check(fmt.Sprintf("listen %s %s:%s", protocol, host, p), checkListen(p))
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, total)
+		return 1
+	}
+	fmt.Printf("All %d checks passed\n", total)
+	return 0
+}
+
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	_, err = os.ReadDir(dir)
+	return err
+}
+
+func checkFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkIndex() error {
+	p, ok := resolvePath(directory, indexFile)
+	if !ok {
+		return errors.New("-index must name a file inside -directory")
+	}
+	return checkFile(p)
+}
+
+func checkTLS() error {
+	if tlsCert == "" || tlsKey == "" {
+		return errors.New("both -tls-cert and -tls-key must be set")
+	}
+	_, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	return err
+}
+
+// checkListen binds p and releases it again straight away.
+func checkListen(p string) error {
+	l, err := listen(p)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
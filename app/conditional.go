@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate layout used in HTTP date headers.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// now is the clock used for the Date response header. It is a variable
+// so that it can be replaced with a fixed time.
+var now = time.Now
+
+// fileETag derives a strong validator from the file size and
+// modification time, so it changes whenever the file is rewritten.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// encodedETag derives the entity tag of a content-coded representation
+// from etag, so that it never validates the unencoded body or the
+// other way round.
+func encodedETag(etag string, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// etagMatches reports whether etag appears in a comma-separated
+// If-None-Match style header, using weak comparison.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch reports whether the If-Match precondition of req holds for
+// the file at p. An absent header always holds, "*" requires the file
+// to exist, and listed entity tags are compared strongly, so weak tags
+// never match.
+func ifMatch(req request, p string) bool {
+	header := req.Header("If-Match")
+	if header == "" {
+		return true
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	etag := fileETag(info)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches reports whether a Range request may be served as
+// partial content given its If-Range header. An absent header always
+// matches; an entity tag must match etag strongly and a date must
+// equal the modification time exactly, otherwise the full file is
+// sent.
+func ifRangeMatches(header string, etag string, modTime time.Time) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return header == etag
+	}
+	date, ok := parseHTTPDate(header)
+	return ok && modTime.Truncate(time.Second).Equal(date)
+}
+
+// parseHTTPDate parses the date formats HTTP/1.1 recipients must
+// accept.
+func parseHTTPDate(value string) (time.Time, bool) {
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// notModifiedSince reports whether a file modified at modTime is
+// unchanged since the If-Modified-Since header value. Unparseable
+// dates never match.
+func notModifiedSince(header string, modTime time.Time) bool {
+	since, ok := parseHTTPDate(header)
+	if !ok {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var configPath string
+
+// Config mirrors the command-line flags so they can be set from a JSON
+// file passed with -config. Keys are the flag names and values use the
+// flag syntax, so durations are strings such as "30s". Fields left out
+// of the file keep their default, and flags given on the command line
+// override the file.
+type Config struct {
+	Protocol        *string  `json:"protocol,omitempty"`
+	Host            *string  `json:"host,omitempty"`
+	Port            *string  `json:"port,omitempty"`
+	Directory       *string  `json:"directory,omitempty"`
+	NoFiles         *bool    `json:"no-files,omitempty"`
+	Index           *string  `json:"index,omitempty"`
+	Favicon         *string  `json:"favicon,omitempty"`
+	NotFoundFile    *string  `json:"notfound-file,omitempty"`
+	ReadTimeout     *string  `json:"read-timeout,omitempty"`
+	WriteTimeout    *string  `json:"write-timeout,omitempty"`
+	IdleTimeout     *string  `json:"idle-timeout,omitempty"`
+	MaxURILength    *int     `json:"max-uri-length,omitempty"`
+	MaxHeaderBytes  *int     `json:"max-header-bytes,omitempty"`
+	MaxBodySize     *int64   `json:"max-body-size,omitempty"`
+	ServerName      *string  `json:"server-name,omitempty"`
+	TLSCert         *string  `json:"tls-cert,omitempty"`
+	TLSKey          *string  `json:"tls-key,omitempty"`
+	CacheSize       *int64   `json:"cache-size,omitempty"`
+	MaxConns        *int     `json:"max-conns,omitempty"`
+	MaxPipeline     *int     `json:"max-pipeline,omitempty"`
+	Rate            *float64 `json:"rate,omitempty"`
+	Burst           *int     `json:"burst,omitempty"`
+	AuthUser        *string  `json:"auth-user,omitempty"`
+	AuthPass        *string  `json:"auth-pass,omitempty"`
+	CORSOrigins     *string  `json:"cors-origins,omitempty"`
+	Mount           []string `json:"mount,omitempty"`
+	Vhost           []string `json:"vhost,omitempty"`
+	Redirect        []string `json:"redirect,omitempty"`
+	Proxy           []string `json:"proxy,omitempty"`
+	StrictSlash     *bool    `json:"strict-slash,omitempty"`
+	StrictHeaders   *bool    `json:"strict-headers,omitempty"`
+	DisableTrace    *bool    `json:"disable-trace,omitempty"`
+	EnableAdmin     *bool    `json:"enable-admin,omitempty"`
+	EnableDebug     *bool    `json:"enable-debug,omitempty"`
+	DebugBuffer     *int     `json:"debug-buffer,omitempty"`
+	Quiet           *bool    `json:"quiet,omitempty"`
+	LogFormat       *string  `json:"log-format,omitempty"`
+	LogSample       *float64 `json:"log-sample,omitempty"`
+	AccessLog       *string  `json:"access-log,omitempty"`
+	ShutdownTimeout *string  `json:"shutdown-timeout,omitempty"`
+}
+
+// loadConfig reads the JSON config file at path. Unknown keys are
+// rejected so that a misspelled option does not go unnoticed.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// apply sets every flag present in cfg that was not given explicitly
+// on the command line.
+func (cfg Config) apply(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	for name, raw := range values {
+		if explicit[name] {
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			var s string
+			if json.Unmarshal(raw, &s) != nil {
+				s = string(raw)
+			}
+			list = []string{s}
+		}
+		for _, v := range list {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("config %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"host": "127.0.0.1", "port": "9999", "read-timeout": "5s", "mount": ["/a=/x", "/b=/y"]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	host := fs.String("host", "0.0.0.0", "")
+	port := fs.String("port", "4221", "")
+	dir := fs.String("directory", "/srv", "")
+	timeout := fs.Duration("read-timeout", 30*time.Second, "")
+	var m mountFlag
+	fs.Var(&m, "mount", "")
+	if err := fs.Parse([]string{"-port", "8080"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *port != "8080" {
+		t.Errorf("port %q, want the command-line 8080 over the file", *port)
+	}
+	if *host != "127.0.0.1" || *timeout != 5*time.Second || len(m) != 2 {
+		t.Errorf("host %q read-timeout %s mounts %v, want the file's values over the defaults", *host, *timeout, m)
+	}
+	if *dir != "/srv" {
+		t.Errorf("directory %q, want the default when neither sets it", *dir)
+	}
+}
+
+func TestConfigRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"prot": "tcp"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("misspelled key accepted")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Cookies parses the Cookie request headers into a map of cookie names
+// to values. Surrounding double quotes are removed from values and
+// pairs without a name are skipped.
+func (r request) Cookies() map[string]string {
+	cookies := make(map[string]string)
+	for _, header := range r.HeaderValues("Cookie") {
+		for _, pair := range strings.Split(header, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+				value = value[1 : len(value)-1]
+			}
+			cookies[name] = value
+		}
+	}
+	return cookies
+}
+
+// CookieOptions holds the attributes written by SetCookie. A zero
+// MaxAge omits the attribute and a negative one deletes the cookie.
+type CookieOptions struct {
+	Path     string
+	MaxAge   int
+	HttpOnly bool
+	Secure   bool
+	SameSite string
+}
+
+// SetCookie appends a Set-Cookie header formatted per RFC 6265.
+func (res *response) SetCookie(name string, value string, opts CookieOptions) {
+	var b strings.Builder
+	b.WriteString(name + "=" + value)
+	if opts.Path != "" {
+		b.WriteString("; Path=" + opts.Path)
+	}
+	if opts.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(opts.MaxAge))
+	} else if opts.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if opts.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if opts.Secure {
+		b.WriteString("; Secure")
+	}
+	if opts.SameSite != "" {
+		b.WriteString("; SameSite=" + opts.SameSite)
+	}
+	res.AddHeader("Set-Cookie", b.String())
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	req, err := parseRequest("GET / HTTP/1.1\r\nHost: x\r\nCookie: a=1; b = two ;empty=; quoted=\"q v\"\r\nCookie: =nameless; ;c=3\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "1", "b": "two", "empty": "", "quoted": "q v", "c": "3"}
+	if got := req.Cookies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cookies() = %v, want %v", got, want)
+	}
+	if got := (request{}).Cookies(); len(got) != 0 {
+		t.Errorf("Cookies() without a header = %v, want none", got)
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	var res response
+	res.SetCookie("session", "abc", CookieOptions{Path: "/", MaxAge: 3600, HttpOnly: true, Secure: true, SameSite: "Lax"})
+	res.SetCookie("old", "", CookieOptions{MaxAge: -1})
+	want := []string{
+		"session=abc; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Lax",
+		"old=; Max-Age=0",
+	}
+	if got := res.headers["Set-Cookie"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+}
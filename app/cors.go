@@ -0,0 +1,46 @@
+package main
+
+import "strings"
+
+var corsOrigins []string
+
+// parseCORSOrigins splits the comma-separated -cors-origins value.
+func parseCORSOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+func corsAllowed(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCORS adds CORS headers to res when the request Origin is in the
+// allowlist. Preflight requests additionally get the allowed methods
+// and headers.
+func applyCORS(req request, res *response) {
+	origin := req.Header("Origin")
+	if origin == "" || !corsAllowed(origin) {
+		return
+	}
+	res.SetHeader("Access-Control-Allow-Origin", origin)
+	res.AddHeader("Vary", "Origin")
+	if !req.IsOptions() || req.Header("Access-Control-Request-Method") == "" {
+		return
+	}
+	if allow := res.headers.Get("Allow"); allow != "" {
+		res.SetHeader("Access-Control-Allow-Methods", allow)
+	}
+	if requested := req.Header("Access-Control-Request-Headers"); requested != "" {
+		res.SetHeader("Access-Control-Allow-Headers", requested)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	enableDebug    bool
+	debugBuffer    int
+	recentRequests *requestRing
+)
+
+// requestRecord is what /debug/requests shows about a handled request.
+type requestRecord struct {
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// requestRing holds the last len(records) handled requests, overwriting
+// the oldest once full. Connections record concurrently, so access is
+// serialized by mu.
+type requestRing struct {
+	mu      sync.Mutex
+	records []requestRecord
+	next    int
+	full    bool
+}
+
+func newRequestRing(size int) *requestRing {
+	if size < 0 {
+		size = 0
+	}
+	return &requestRing{records: make([]requestRecord, size)}
+}
+
+// record adds a request to the ring. It is a no-op on a nil or empty
+// ring, so callers need not check whether -enable-debug is set.
+func (r *requestRing) record(req request, res response, at time.Time) {
+	if r == nil || len(r.records) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[r.next] = requestRecord{Method: req.method, Path: req.path, Status: res.statusCode, Timestamp: at}
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the recorded requests, newest first.
+func (r *requestRing) snapshot() []requestRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.records)
+	}
+	out := make([]requestRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.records[(r.next-i+len(r.records))%len(r.records)])
+	}
+	return out
+}
+
+// handleDebugRequests lists the most recent requests as an HTML table,
+// or as a JSON array for clients preferring JSON.
+func handleDebugRequests(req request, res *response) {
+	records := recentRequests.snapshot()
+	if negotiateType(req, []string{TypeTextHTML, TypeJSON}) == TypeJSON {
+		res.JSON(ResponseOK, records)
+		return
+	}
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><title>Recent requests</title></head><body>\n<h1>Recent requests</h1>\n<table>\n")
+	b.WriteString("<tr><th>Time</th><th>Method</th><th>Path</th><th>Status</th></tr>\n")
+	for _, r := range records {
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%d</td></tr>\n", r.Timestamp.Format(time.RFC3339), html.EscapeString(r.Method), html.EscapeString(r.Path), r.Status)
+	}
+	b.WriteString("</table>\n</body></html>\n")
+	responseContent(res, []byte(b.String()), TypeTextHTML)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeFormURLEncoded = "application/x-www-form-urlencoded"
+	TypeMultipartForm  = "multipart/form-data"
+)
+
+// formCache holds the lazily parsed body of a request so that repeated
+// calls to Form share one parse.
+type formCache struct {
+	once   sync.Once
+	values map[string][]string
+}
+
+// Form returns the key/value pairs of an
+// application/x-www-form-urlencoded body. Other content types yield an
+// empty map. Malformed pairs are skipped.
+func (r request) Form() map[string][]string {
+	if r.form == nil {
+		return parseForm(r)
+	}
+	r.form.once.Do(func() {
+		r.form.values = parseForm(r)
+	})
+	return r.form.values
+}
+
+func parseForm(r request) map[string][]string {
+	if mediaType(r.Header("Content-Type")) != TypeFormURLEncoded {
+		return map[string][]string{}
+	}
+	values, _ := url.ParseQuery(r.body)
+	return values
+}
+
+// mediaType returns the lowercased media type of a Content-Type value
+// without its parameters.
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// formPart is a single part of a multipart/form-data body.
+type formPart struct {
+	name     string
+	filename string
+	headers  headers
+	content  []byte
+}
+
+// multipartForm holds a parsed multipart/form-data body. Parts without
+// a filename are collected as values, the rest as files, both keyed by
+// form field name.
+type multipartForm struct {
+	values map[string][]string
+	files  map[string][]formPart
+	parts  []formPart
+}
+
+// File returns the first file uploaded under name.
+func (f *multipartForm) File(name string) (formPart, bool) {
+	if files := f.files[name]; len(files) > 0 {
+		return files[0], true
+	}
+	return formPart{}, false
+}
+
+// MultipartForm parses a multipart/form-data body using the boundary
+// from the Content-Type header. The combined size of all parts is
+// capped by -max-body-size.
+func (r request) MultipartForm() (*multipartForm, error) {
+	t, params, err := mime.ParseMediaType(r.Header("Content-Type"))
+	if err != nil || t != TypeMultipartForm {
+		return nil, fmt.Errorf("%w: not a multipart/form-data request", errMalformedRequest)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: multipart boundary missing", errMalformedRequest)
+	}
+	form := &multipartForm{
+		values: make(map[string][]string),
+		files:  make(map[string][]formPart),
+	}
+	mr := multipart.NewReader(strings.NewReader(r.body), boundary)
+	var total int64
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errMalformedRequest, err.Error())
+		}
+		content, err := io.ReadAll(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errMalformedRequest, err.Error())
+		}
+		total += int64(len(content))
+		if maxBodySize > 0 && total > maxBodySize {
+			return nil, fmt.Errorf("%w: multipart content exceeds limit of %d", errBodyTooLarge, maxBodySize)
+		}
+		part := formPart{
+			name:     p.FormName(),
+			filename: p.FileName(),
+			headers:  headers(p.Header),
+			content:  content,
+		}
+		form.parts = append(form.parts, part)
+		if part.filename == "" {
+			form.values[part.name] = append(form.values[part.name], string(content))
+		} else {
+			form.files[part.name] = append(form.files[part.name], part)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+var (
+	logger        = log.New(os.Stdout, "", log.LstdFlags)
+	eventLogger   = log.New(os.Stdout, "", 0)
+	quiet         bool
+	logFormat     string
+	logSample     float64
+	accessLogPath string
+	accessLog     *accessLogger
+)
+
+// accessLogger appends Common Log Format lines to w. Connections log
+// concurrently, so writes are serialized by mu.
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openAccessLog opens path for appending, creating it if needed.
+func openAccessLog(path string) (*accessLogger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{w: f}, nil
+}
+
+// log writes a line such as
+// `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /echo/hi HTTP/1.1" 200 2`
+// for a response with n body bytes.
+func (l *accessLogger) log(conn net.Conn, req request, res response, at time.Time, n int64) {
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	target := req.path
+	if req.rawQuery != "" {
+		target += "?" + req.rawQuery
+	}
+	size := "-"
+	if n > 0 {
+		size = strconv.FormatInt(n, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %s %s\n", host, at.Format(clfTimeFormat), req.method, target, req.version, strconv.Itoa(res.statusCode), size)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
+
+// logEvent is a request log line in -log-format json.
+type logEvent struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	RemoteAddr string  `json:"remote_addr"`
+	RequestID  string  `json:"request_id"`
+}
+
+// logRequest writes a single line describing a handled request, e.g.
+// "127.0.0.1:5555 GET /echo/hi 200 1.2ms 2b 9f86d081884c7d659a2feaa0c55ad015",
+// or a logEvent object in -log-format json. n is the number of body
+// bytes actually written, which streamed responses only know once sent.
+func logRequest(conn net.Conn, req request, res response, start time.Time, n int64) {
+	if !sampled(res) {
+		return
+	}
+	if accessLog != nil {
+		accessLog.log(conn, req, res, start, n)
+	}
+	if quiet {
+		return
+	}
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+	if logFormat == "json" {
+		b, _ := json.Marshal(logEvent{
+			Method:     req.method,
+			Path:       req.path,
+			Status:     res.statusCode,
+			Bytes:      n,
+			DurationMS: elapsed,
+			RemoteAddr: conn.RemoteAddr().String(),
+			RequestID:  req.id,
+		})
+		eventLogger.Print(string(b))
+		return
+	}
+	logger.Printf("%s %s %s %d %.1fms %db %s", conn.RemoteAddr(), req.method, req.path, res.statusCode, elapsed, n, req.id)
+}
+
+// sampled decides once per request whether it is logged, so that the
+// access log and the per-request log agree. Responses outside 2xx are
+// always logged; the rest are kept with probability -log-sample.
+func sampled(res response) bool {
+	if res.statusCode < 200 || res.statusCode > 299 || logSample >= 1 {
+		return true
+	}
+	return rand.Float64() < logSample
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+const TypeMetrics = "text/plain; version=0.0.4"
+
+// serverMetrics holds the counters exposed at /metrics. All fields are
+// updated atomically from connection goroutines.
+type serverMetrics struct {
+	requests          atomic.Int64
+	statusClasses     [5]atomic.Int64
+	activeConnections atomic.Int64
+	bytesWritten      atomic.Int64
+}
+
+var metrics serverMetrics
+
+// recordResponse counts a written response with the given status code
+// and number of bytes sent on the wire.
+func (m *serverMetrics) recordResponse(code int, written int64) {
+	m.requests.Add(1)
+	m.bytesWritten.Add(written)
+	if class := code / 100; class >= 1 && class <= 5 {
+		m.statusClasses[class-1].Add(1)
+	}
+}
+
+func handleMetrics(req request, res *response) {
+	var b strings.Builder
+	b.WriteString("# HELP http_requests_total Total number of handled requests.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	fmt.Fprintf(&b, "http_requests_total %d\n", metrics.requests.Load())
+	b.WriteString("# HELP http_responses_total Responses by status class.\n")
+	b.WriteString("# TYPE http_responses_total counter\n")
+	for i := range metrics.statusClasses {
+		fmt.Fprintf(&b, "http_responses_total{class=\"%dxx\"} %d\n", i+1, metrics.statusClasses[i].Load())
+	}
+	b.WriteString("# HELP http_active_connections Currently open client connections.\n")
+	b.WriteString("# TYPE http_active_connections gauge\n")
+	fmt.Fprintf(&b, "http_active_connections %d\n", metrics.activeConnections.Load())
+	b.WriteString("# HELP http_response_bytes_total Bytes written in responses, including headers.\n")
+	b.WriteString("# TYPE http_response_bytes_total counter\n")
+	fmt.Fprintf(&b, "http_response_bytes_total %d\n", metrics.bytesWritten.Load())
+	responseContent(res, []byte(b.String()), TypeMetrics)
+	// The exposition format names its own parameters, which a charset
+	// added by responseContent would not match.
+	res.SetHeader("Content-Type", TypeMetrics)
+}
+
+// countingWriter counts the bytes successfully written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
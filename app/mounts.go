@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// mount serves the directory root under the URL prefix.
+type mount struct {
+	prefix string
+	root   string
+}
+
+// mountFlag collects repeated -mount /prefix=/dir flags.
+type mountFlag []mount
+
+var mounts mountFlag
+
+func (m mountFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for _, mt := range m {
+		pairs = append(pairs, mt.prefix+"="+mt.root)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *mountFlag) Set(value string) error {
+	prefix, root, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || root == "" {
+		return errors.New("mount must be of the form /prefix=/dir")
+	}
+	*m = append(*m, mount{prefix: cleanPath(prefix), root: root})
+	return nil
+}
+
+func (mt mount) routePrefix() string { return mt.prefix }
+
+// handleMount serves files from the root of the mount covering the
+// request path. Each mount keeps its own traversal protection, so
+// "/static/../x" cannot reach outside the mounted directory.
+func handleMount(req request, res *response) {
+	mt, name, ok := lookupPrefix(mounts, req.path)
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	serveFile(req, res, mt.root, name)
+}
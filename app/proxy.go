@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// proxyRoute forwards requests under the URL prefix to upstream.
+type proxyRoute struct {
+	prefix   string
+	upstream *url.URL
+}
+
+// proxyFlag collects repeated -proxy /prefix=http://host:port flags.
+type proxyFlag []proxyRoute
+
+var proxies proxyFlag
+
+// proxyMethods are the methods forwarded to an upstream. HEAD gets a
+// route of its own so the upstream sees HEAD rather than GET.
+var proxyMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// hopHeaders only describe a single connection and are never passed
+// on by a proxy. Expect is dropped too, since the body has already
+// been read from the client.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Expect"}
+
+func (p proxyFlag) String() string {
+	pairs := make([]string, 0, len(p))
+	for _, pr := range p {
+		pairs = append(pairs, pr.prefix+"="+pr.upstream.String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p *proxyFlag) Set(value string) error {
+	prefix, target, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return errors.New("proxy must be of the form /prefix=http://host:port")
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return errors.New("proxy upstream must be an http:// URL with a host")
+	}
+	*p = append(*p, proxyRoute{prefix: cleanPath(prefix), upstream: u})
+	return nil
+}
+
+func (pr proxyRoute) routePrefix() string { return pr.prefix }
+
+// handleProxy forwards req to the upstream of the proxy covering its
+// path, with the prefix replaced by the upstream's own path, and
+// relays the upstream response. Every request opens a new upstream
+// connection and asks for HTTP/1.0, so the response body is either
+// sized by Content-Length or delimited by the upstream closing.
+func handleProxy(req request, res *response) {
+	pr, rest, ok := lookupPrefix(proxies, req.path)
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	target := (&url.URL{Path: strings.TrimSuffix(pr.upstream.Path, "/") + "/" + rest}).EscapedPath()
+	if req.rawQuery != "" {
+		target += "?" + req.rawQuery
+	}
+	conn, err := net.DialTimeout("tcp", upstreamAddr(pr.upstream), readTimeout)
+	if err != nil {
+		proxyError(req, res, err)
+		return
+	}
+	conn.SetDeadline(deadline(readTimeout))
+	if err := writeUpstreamRequest(conn, req, pr.upstream.Host, target); err != nil {
+		conn.Close()
+		proxyError(req, res, err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+	up, err := readUpstreamResponse(reader)
+	if err != nil {
+		conn.Close()
+		proxyError(req, res, err)
+		return
+	}
+	*res = up
+	bodyless := req.IsHead() || res.statusCode == ResponseNoContent || res.statusCode == ResponseNotModified || res.statusCode < 200
+	switch {
+	case bodyless:
+		conn.Close()
+	case res.headers.Get("Transfer-Encoding") == "chunked":
+		// Not expected in reply to HTTP/1.0, but cheap to handle.
+		defer conn.Close()
+		body, err := readChunkedBody(reader)
+		if err != nil {
+			*res = response{}
+			proxyError(req, res, err)
+			return
+		}
+		res.headers.Del("Transfer-Encoding")
+		res.headers.Del("Content-Length")
+		res.content = body
+	case res.headers.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(res.headers.Get("Content-Length"), 10, 64)
+		if err != nil || n < 0 {
+			conn.Close()
+			*res = response{}
+			proxyError(req, res, fmt.Errorf("invalid upstream Content-Length %q", res.headers.Get("Content-Length")))
+			return
+		}
+		res.bodyReader = upstreamBody{r: io.LimitReader(reader, n), conn: conn}
+	default:
+		res.SetHeader("Transfer-Encoding", "chunked")
+		res.bodyReader = upstreamBody{r: reader, conn: conn}
+	}
+}
+
+// upstreamAddr returns the host:port to dial for u, defaulting to
+// port 80.
+func upstreamAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// writeUpstreamRequest sends req to w for target on host, without
+// hop-by-hop headers and with the client added to X-Forwarded-For.
+func writeUpstreamRequest(w io.Writer, req request, host string, target string) error {
+	h := make(headers, len(req.headers))
+	for k, values := range req.headers {
+		h[k] = append([]string(nil), values...)
+	}
+	stripHopHeaders(h)
+	h.Set("Host", host)
+	client := remoteIP(req.remoteAddr)
+	if prior := h["X-Forwarded-For"]; len(prior) > 0 {
+		client = strings.Join(prior, ", ") + ", " + client
+	}
+	h.Set("X-Forwarded-For", client)
+	h.Set("Connection", "close")
+	if len(req.body) > 0 || req.Header("Content-Length") != "" {
+		h.Set("Content-Length", strconv.Itoa(len(req.body)))
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.0\r\n", req.method, target)
+	for k, values := range h {
+		for _, v := range values {
+			fmt.Fprintf(bw, "%s: %s\r\n", k, v)
+		}
+	}
+	bw.WriteString("\r\n")
+	bw.WriteString(req.body)
+	return bw.Flush()
+}
+
+// readUpstreamResponse reads the status line and headers of an
+// upstream response, leaving the body in reader. Hop-by-hop headers
+// other than Transfer-Encoding, which frames the body, are dropped.
+func readUpstreamResponse(reader *bufio.Reader) (response, error) {
+	var res response
+	headerSize := 0
+	line, err := readHeaderLine(reader, &headerSize)
+	if err != nil {
+		return res, err
+	}
+	fields := strings.SplitN(strings.TrimRight(string(line), "\r\n"), " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") {
+		return res, fmt.Errorf("invalid upstream status line %q", line)
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil || code < 100 || code > 999 {
+		return res, fmt.Errorf("invalid upstream status %q", fields[1])
+	}
+	res.statusCode = code
+	if len(fields) == 3 {
+		res.reason = fields[2]
+	}
+	headerBytes, err := readHeaderSection(reader, &headerSize)
+	if err != nil {
+		return res, err
+	}
+	var up request
+	if err := parseHeaderLines(headerBytes, &up); err != nil {
+		return res, err
+	}
+	te := up.headers.Get("Transfer-Encoding")
+	stripHopHeaders(up.headers)
+	if te != "" {
+		up.headers.Set("Transfer-Encoding", te)
+	}
+	res.headers = up.headers
+	return res, nil
+}
+
+// stripHopHeaders removes hopHeaders from h, along with any header
+// named in its Connection header.
+func stripHopHeaders(h headers) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// proxyError answers 504 when the upstream timed out and 502 for any
+// other failure to reach it or to understand its response.
+func proxyError(req request, res *response, err error) {
+	fmt.Println("Error proxying request: ", err.Error())
+	var ne net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		responseError(req, res, ResponseGatewayTimeout, "upstream timed out")
+		return
+	}
+	responseError(req, res, ResponseBadGateway, "bad gateway")
+}
+
+// upstreamBody streams an upstream response body to the client. Each
+// read pushes the upstream read deadline forward, so -read-timeout
+// bounds a stalled upstream rather than the whole transfer. Closing it
+// closes the upstream connection.
+type upstreamBody struct {
+	r    io.Reader
+	conn net.Conn
+}
+
+func (b upstreamBody) Read(p []byte) (int, error) {
+	b.conn.SetReadDeadline(deadline(readTimeout))
+	return b.r.Read(p)
+}
+
+func (b upstreamBody) Close() error {
+	return b.conn.Close()
+}
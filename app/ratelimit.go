@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit   float64
+	rateBurst   int
+	rateLimiter *ipRateLimiter
+)
+
+// bucket is a token bucket holding up to burst tokens, refilled at
+// rate tokens per second since last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ipRateLimiter keeps one token bucket per client IP. Buckets that have
+// refilled completely carry no state worth keeping and are dropped by
+// cleanup.
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &ipRateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of ip. When the bucket is empty
+// it returns false and how long until the next token is available.
+func (l *ipRateLimiter) allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup removes buckets that would be full again by now.
+func (l *ipRateLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for ip, b := range l.buckets {
+		if time.Since(b.last) > full {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// runCleanup calls cleanup every interval, forever.
+func (l *ipRateLimiter) runCleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.cleanup()
+	}
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// handleTooManyRequests answers 429 with Retry-After rounded up to
+// whole seconds.
+func handleTooManyRequests(res *response, wait time.Duration) {
+	res.statusCode = ResponseTooManyRequests
+	res.SetHeader("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// redirectFlag collects repeated -redirect from=to flags.
+type redirectFlag map[string]string
+
+var redirects = redirectFlag{}
+
+func (r redirectFlag) String() string {
+	pairs := make([]string, 0, len(r))
+	for from, to := range r {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (r redirectFlag) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" || to == "" {
+		return errors.New("redirect must be of the form /from=/to")
+	}
+	r[from] = to
+	return nil
+}
+
+// redirectTo returns a handler answering with a permanent redirect to
+// target, carrying over the request query string.
+func redirectTo(target string) HandlerFunc {
+	return func(req request, res *response) {
+		location := target
+		if req.rawQuery != "" {
+			if strings.Contains(location, "?") {
+				location += "&" + req.rawQuery
+			} else {
+				location += "?" + req.rawQuery
+			}
+		}
+		res.statusCode = ResponseMovedPermanently
+		res.SetHeader("Location", location)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// requestID returns the client supplied X-Request-Id so that upstream
+// correlation survives, or a freshly generated one otherwise.
+func requestID(req request) string {
+	if id := req.Header("X-Request-Id"); id != "" {
+		return id
+	}
+	return randomID()
+}
+
+// randomID returns 16 random bytes encoded as a hex string.
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// strictSlash makes a request whose path only matches a route once its
+// trailing slash is removed redirect to that canonical path instead of
+// being served as if the slash was absent.
+var strictSlash bool
+
+type HandlerFunc func(req request, res *response)
+
+// Middleware wraps a handler with behaviour that runs around it. A
+// middleware can short-circuit the request by not calling next, as
+// requireAuth does for bad credentials.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type route struct {
+	method   string
+	segments []string
+	handler  HandlerFunc
+}
+
+// Router dispatches requests to the first registered route whose
+// method and pattern match. Patterns are matched segment by segment:
+// a ":name" segment captures exactly one non-empty path segment and a
+// trailing "*name" segment captures the remainder of the path, which
+// may be empty. Captured values are stored in req.params. A HEAD
+// request is served by a matching HEAD route if one is registered and
+// otherwise by the matching GET route, with the body dropped.
+type Router struct {
+	routes     []route
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+func (rt *Router) Handle(method string, pattern string, h HandlerFunc) {
+	rt.routes = append(rt.routes, route{method: method, segments: splitPath(pattern), handler: h})
+}
+
+// ServeRequest routes req after normalizing its path. Repeated slashes
+// are always collapsed, so "//echo//hi" is routed as "/echo/hi". A
+// single trailing slash is dropped when the path matches no route with
+// it but does without it, e.g. "/echo/hi/" or "/user-agent/"; paths
+// matched by a "*name" route such as "/files/dir/" keep their slash. In
+// -strict-slash mode such requests get a 301 to the path without the
+// slash instead.
+//
+// Routes are matched against the path as received, split at its
+// slashes before each segment is decoded, so an encoded slash stays
+// inside its segment: "/echo/a%2Fb" captures "a/b" as :msg.
+func (rt *Router) ServeRequest(req request, res *response) {
+	req.path = cleanPath(req.path)
+	req.rawPath = cleanPath(req.rawPath)
+	if trimmed, ok := rt.trailingSlashFallback(req.path); ok {
+		rawTrimmed := strings.TrimSuffix(req.rawPath, "/")
+		if strictSlash {
+			if rawTrimmed == "" {
+				rawTrimmed = (&url.URL{Path: trimmed}).EscapedPath()
+			}
+			redirectTo(rawTrimmed)(req, res)
+			return
+		}
+		req.path, req.rawPath = trimmed, rawTrimmed
+	}
+	if req.IsOptions() {
+		handleOptions(rt, req, res)
+		return
+	}
+	segments := pathSegments(req)
+	if h, params, ok := rt.find(req.method, segments); ok {
+		req.params = params
+		rt.chain(h)(req, res)
+		return
+	}
+	// HEAD without a route of its own runs the GET handler, which sees
+	// a GET request, and keeps its headers but drops the body.
+	if req.IsHead() {
+		if h, params, ok := rt.find("GET", segments); ok {
+			req.method = "GET"
+			req.params = params
+			rt.chain(h)(req, res)
+			res.omitBody = true
+			return
+		}
+	}
+	if methods := rt.Allowed(req.path); len(methods) > 0 {
+		res.statusCode = ResponseMethodNotAllowed
+		res.SetHeader("Allow", strings.Join(methods, ", "))
+		return
+	}
+	res.statusCode = ResponseNotFound
+}
+
+// Use appends mw to the chain run before every matched handler. The
+// chain runs in registration order, so the first middleware registered
+// sees the request first.
+func (rt *Router) Use(mw ...Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+}
+
+// Allowed returns the sorted methods registered for path, including
+// HEAD wherever GET is registered. The asterisk-form "*" path returns
+// every method known to the router.
+func (rt *Router) Allowed(path string) []string {
+	segments := splitPath(path)
+	set := make(map[string]bool)
+	for _, r := range rt.routes {
+		if path == "*" {
+			set[r.method] = true
+		} else if _, ok := r.match(segments); ok {
+			set[r.method] = true
+		}
+	}
+	if set["GET"] {
+		set["HEAD"] = true
+	}
+	methods := make([]string, 0, len(set))
+	for m := range set {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// find returns the handler of the first route registered for method
+// that matches segments, along with the captured params.
+func (rt *Router) find(method string, segments []string) (HandlerFunc, map[string]string, bool) {
+	for _, r := range rt.routes {
+		if r.method != method {
+			continue
+		}
+		if params, ok := r.match(segments); ok {
+			return r.handler, params, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (rt *Router) chain(h HandlerFunc) HandlerFunc {
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+	return h
+}
+
+// trailingSlashFallback returns path without its trailing slash when
+// only that form is known to the router.
+func (rt *Router) trailingSlashFallback(path string) (string, bool) {
+	trimmed, ok := strings.CutSuffix(path, "/")
+	if !ok || trimmed == "" {
+		return "", false
+	}
+	if len(rt.Allowed(path)) > 0 || len(rt.Allowed(trimmed)) == 0 {
+		return "", false
+	}
+	return trimmed, true
+}
+
+func handleOptions(rt *Router, req request, res *response) {
+	methods := rt.Allowed(req.path)
+	if len(methods) == 0 {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	res.statusCode = ResponseNoContent
+	res.SetHeader("Allow", strings.Join(methods, ", "))
+}
+
+func (r route) match(segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, s := range r.segments {
+		if i >= len(segments) {
+			return nil, false
+		}
+		if name, ok := strings.CutPrefix(s, "*"); ok {
+			params[name] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if name, ok := strings.CutPrefix(s, ":"); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[name] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// cleanPath collapses runs of slashes into one.
+func cleanPath(path string) string {
+	if !strings.Contains(path, "//") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// prefixRoute is a route covering every path below a URL prefix, as
+// set up by -mount and -proxy.
+type prefixRoute interface {
+	routePrefix() string
+}
+
+// byPrefixLength returns routes ordered from the longest prefix to the
+// shortest, so that routes for nested prefixes are registered first.
+func byPrefixLength[T prefixRoute](routes []T) []T {
+	sorted := append([]T(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].routePrefix()) > len(sorted[j].routePrefix())
+	})
+	return sorted
+}
+
+// lookupPrefix returns the route with the longest prefix covering path,
+// along with the remainder of path below that prefix. A prefix only
+// covers whole segments: "/static" covers "/static/x" but not
+// "/statics".
+func lookupPrefix[T prefixRoute](routes []T, path string) (T, string, bool) {
+	for _, r := range byPrefixLength(routes) {
+		prefix := strings.TrimSuffix(r.routePrefix(), "/")
+		if rest, ok := strings.CutPrefix(path, prefix); ok && (rest == "" || rest[0] == '/') {
+			return r, strings.TrimPrefix(rest, "/"), true
+		}
+	}
+	var zero T
+	return zero, "", false
+}
+
+// pathSegments returns the decoded segments of the path of req as
+// received. Requests built without a raw path split the decoded one.
+func pathSegments(req request) []string {
+	if req.rawPath == "" {
+		return splitPath(req.path)
+	}
+	segments := splitPath(req.rawPath)
+	for i, s := range segments {
+		if decoded, err := url.PathUnescape(s); err == nil {
+			segments[i] = decoded
+		}
+	}
+	return segments
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouterParams(t *testing.T) {
+	rt := NewRouter()
+	var got map[string]string
+	rt.Handle("GET", "/users/:id/posts/:pid", func(req request, res *response) {
+		got = req.params
+	})
+	tests := []struct {
+		path   string
+		status int
+		params map[string]string
+	}{
+		{"/users/7/posts/42", 0, map[string]string{"id": "7", "pid": "42"}},
+		{"/users//posts/42", ResponseNotFound, nil},
+		{"/users/7/posts", ResponseNotFound, nil},
+		{"/users/7/posts/42/x", ResponseNotFound, nil},
+	}
+	for _, tt := range tests {
+		got = nil
+		var res response
+		rt.ServeRequest(request{method: "GET", path: tt.path}, &res)
+		if res.statusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, res.statusCode, tt.status)
+		}
+		if tt.params != nil && (got["id"] != tt.params["id"] || got["pid"] != tt.params["pid"]) {
+			t.Errorf("%s: params %v, want %v", tt.path, got, tt.params)
+		}
+	}
+}
+
+func TestRouterExplicitHeadTakesPrecedence(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET", "/x", func(req request, res *response) {
+		responseContent(res, []byte("get"), TypeTextPlain)
+	})
+	rt.Handle("HEAD", "/x", func(req request, res *response) {
+		res.statusCode = ResponseNoContent
+	})
+	var res response
+	rt.ServeRequest(request{method: "HEAD", path: "/x"}, &res)
+	if res.statusCode != ResponseNoContent {
+		t.Errorf("HEAD status %d, want the HEAD route's %d", res.statusCode, ResponseNoContent)
+	}
+}
+
+func TestMiddlewareOrderAndShortCircuit(t *testing.T) {
+	rt := NewRouter()
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(req request, res *response) {
+				calls = append(calls, name)
+				next(req, res)
+			}
+		}
+	}
+	deny := func(next HandlerFunc) HandlerFunc {
+		return func(req request, res *response) {
+			if req.Header("Authorization") == "" {
+				res.statusCode = ResponseUnauthorized
+				return
+			}
+			next(req, res)
+		}
+	}
+	rt.Use(trace("first"), trace("second"))
+	rt.Use(deny)
+	rt.Handle("GET", "/x", func(req request, res *response) {
+		calls = append(calls, "handler")
+		res.statusCode = ResponseOK
+	})
+	tests := []struct {
+		auth   string
+		status int
+		calls  string
+	}{
+		{"", ResponseUnauthorized, "first,second"},
+		{"Basic x", ResponseOK, "first,second,handler"},
+	}
+	for _, tt := range tests {
+		calls = nil
+		var res response
+		rt.ServeRequest(request{method: "GET", path: "/x", headers: headers{"Authorization": {tt.auth}}}, &res)
+		if res.statusCode != tt.status {
+			t.Errorf("auth %q: status %d, want %d", tt.auth, res.statusCode, tt.status)
+		}
+		if got := strings.Join(calls, ","); got != tt.calls {
+			t.Errorf("auth %q: calls %s, want %s", tt.auth, got, tt.calls)
+		}
+	}
+	calls = nil
+	var res response
+	rt.ServeRequest(request{method: "GET", path: "/missing"}, &res)
+	if res.statusCode != ResponseNotFound || len(calls) != 0 {
+		t.Errorf("unmatched path: status %d calls %v, want 404 without middleware", res.statusCode, calls)
+	}
+}
+
+func TestLookupPrefix(t *testing.T) {
+	routes := mountFlag{{prefix: "/static", root: "a"}, {prefix: "/static/img", root: "b"}}
+	tests := []struct {
+		path, root, rest string
+		ok               bool
+	}{
+		{"/static/x.css", "a", "x.css", true},
+		{"/static/img/y.png", "b", "y.png", true},
+		{"/static", "a", "", true},
+		{"/statics/x", "", "", false},
+	}
+	for _, tt := range tests {
+		mt, rest, ok := lookupPrefix(routes, tt.path)
+		if ok != tt.ok || mt.root != tt.root || rest != tt.rest {
+			t.Errorf("%s: got %q %q %v, want %q %q %v", tt.path, mt.root, rest, ok, tt.root, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestServeRequestSlashes(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET", "/echo/:msg", func(req request, res *response) {
+		responseContent(res, []byte(req.params["msg"]), TypeTextPlain)
+	})
+	rt.Handle("GET", "/files/*name", func(req request, res *response) {
+		responseContent(res, []byte(req.params["name"]), TypeTextPlain)
+	})
+	tests := []struct {
+		name     string
+		strict   bool
+		path     string
+		query    string
+		status   int
+		body     string
+		location string
+	}{
+		{"collapse only", false, "//echo//hi", "", ResponseOK, "hi", ""},
+		{"catch-all keeps its slash", false, "/files/dir/", "", ResponseOK, "dir/", ""},
+		{"trailing slash fallback", false, "/echo/hi/", "", ResponseOK, "hi", ""},
+		{"collapse and fallback", false, "//echo/hi//", "", ResponseOK, "hi", ""},
+		{"strict redirect keeps query", true, "/echo/hi/", "a=1&b=2", ResponseMovedPermanently, "", "/echo/hi?a=1&b=2"},
+		{"strict still collapses", true, "//echo//hi", "", ResponseOK, "hi", ""},
+		{"strict catch-all not redirected", true, "/files/dir/", "", ResponseOK, "dir/", ""},
+	}
+	defer func() { strictSlash = false }()
+	for _, tt := range tests {
+		strictSlash = tt.strict
+		var res response
+		rt.ServeRequest(request{method: "GET", path: tt.path, rawPath: tt.path, rawQuery: tt.query}, &res)
+		if res.statusCode != tt.status || string(res.content) != tt.body || res.headers.Get("Location") != tt.location {
+			t.Errorf("%s: got %d %q Location %q, want %d %q Location %q", tt.name, res.statusCode, res.content, res.headers.Get("Location"), tt.status, tt.body, tt.location)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	rt := NewRouter()
+	noop := func(req request, res *response) {}
+	rt.Handle("GET", "/echo/:msg", noop)
+	rt.Handle("POST", "/files/*name", noop)
+	rt.Handle("DELETE", "/files/*name", noop)
+	tests := []struct {
+		path   string
+		status int
+		allow  string
+	}{
+		{"*", ResponseNoContent, "DELETE, GET, HEAD, POST"},
+		{"/echo/hi", ResponseNoContent, "GET, HEAD"},
+		{"/files/a.txt", ResponseNoContent, "DELETE, POST"},
+		{"/nope", ResponseNotFound, ""},
+	}
+	for _, tt := range tests {
+		var res response
+		rt.ServeRequest(request{method: "OPTIONS", path: tt.path}, &res)
+		if res.statusCode != tt.status || res.headers.Get("Allow") != tt.allow {
+			t.Errorf("OPTIONS %s: got %d Allow %q, want %d Allow %q", tt.path, res.statusCode, res.headers.Get("Allow"), tt.status, tt.allow)
+		}
+	}
+}
+
+func TestOptionsAsteriskOnTheWire(t *testing.T) {
+	res := roundTrip(t, "OPTIONS * HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 1 || res[0].status != ResponseNoContent || !strings.Contains(res[0].headers.Get("Allow"), "GET") {
+		t.Errorf("got %+v, want 204 listing the server's methods", res)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	res := roundTrip(t, "POST /user-agent HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\nPOST /echo/x HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	if len(res) != 2 {
+		t.Fatalf("got %d responses, want 2", len(res))
+	}
+	for i, r := range res {
+		if r.status != ResponseMethodNotAllowed || r.headers.Get("Allow") != "GET, HEAD" {
+			t.Errorf("response %d: got %d Allow %q, want 405 Allow \"GET, HEAD\"", i+1, r.status, r.headers.Get("Allow"))
+		}
+	}
+}
@@ -1,57 +1,322 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
 	"net"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
-	ResponseOK            = "HTTP/1.1 200 OK"
-	ResponseCreated       = "HTTP/1.1 201 Created"
-	ResponseNotFound      = "HTTP/1.1 404 Not Found"
-	ResponseInternalError = "HTTP/1.1 500 Internal Server Error"
-	TypeTextPlain         = "text/plain"
-	TypeOctetStream       = "application/octet-stream"
+	ResponseContinue             = 100
+	ResponseSwitchingProtocols   = 101
+	ResponseOK                   = 200
+	ResponseCreated              = 201
+	ResponseNoContent            = 204
+	ResponsePartialContent       = 206
+	ResponseMovedPermanently     = 301
+	ResponseFound                = 302
+	ResponseNotModified          = 304
+	ResponseBadRequest           = 400
+	ResponseUnauthorized         = 401
+	ResponseForbidden            = 403
+	ResponseNotFound             = 404
+	ResponseMethodNotAllowed     = 405
+	ResponseRequestTimeout       = 408
+	ResponsePreconditionFailed   = 412
+	ResponsePayloadTooLarge      = 413
+	ResponseURITooLong           = 414
+	ResponseRangeNotSatisfiable  = 416
+	ResponseUpgradeRequired      = 426
+	ResponseTooManyRequests      = 429
+	ResponseHeaderFieldsTooLarge = 431
+	ResponseInternalError        = 500
+	ResponseNotImplemented       = 501
+	ResponseBadGateway           = 502
+	ResponseServiceUnavailable   = 503
+	ResponseGatewayTimeout       = 504
+	ResponseVersionNotSupported  = 505
 )
 
+const (
+	TypeTextPlain   = "text/plain"
+	TypeTextHTML    = "text/html"
+	TypeOctetStream = "application/octet-stream"
+	TypeIcon        = "image/x-icon"
+	TypeJSON        = "application/json"
+	EncodingGzip    = "gzip"
+)
+
+// statusReasons holds the reason phrase sent for each status code.
+var statusReasons = map[int]string{
+	ResponseContinue:             "Continue",
+	ResponseSwitchingProtocols:   "Switching Protocols",
+	ResponseOK:                   "OK",
+	ResponseCreated:              "Created",
+	ResponseNoContent:            "No Content",
+	ResponsePartialContent:       "Partial Content",
+	ResponseMovedPermanently:     "Moved Permanently",
+	ResponseFound:                "Found",
+	ResponseNotModified:          "Not Modified",
+	ResponseBadRequest:           "Bad Request",
+	ResponseUnauthorized:         "Unauthorized",
+	ResponseForbidden:            "Forbidden",
+	ResponseNotFound:             "Not Found",
+	ResponseMethodNotAllowed:     "Method Not Allowed",
+	ResponseRequestTimeout:       "Request Timeout",
+	ResponsePreconditionFailed:   "Precondition Failed",
+	ResponsePayloadTooLarge:      "Payload Too Large",
+	ResponseURITooLong:           "URI Too Long",
+	ResponseRangeNotSatisfiable:  "Range Not Satisfiable",
+	ResponseUpgradeRequired:      "Upgrade Required",
+	ResponseTooManyRequests:      "Too Many Requests",
+	ResponseHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	ResponseInternalError:        "Internal Server Error",
+	ResponseNotImplemented:       "Not Implemented",
+	ResponseBadGateway:           "Bad Gateway",
+	ResponseServiceUnavailable:   "Service Unavailable",
+	ResponseGatewayTimeout:       "Gateway Timeout",
+	ResponseVersionNotSupported:  "HTTP Version Not Supported",
+}
+
+// status returns the three-digit code and reason phrase for code.
+// Codes missing from statusReasons get an empty reason.
+func status(code int) (string, string) {
+	return strconv.Itoa(code), statusReasons[code]
+}
+
+// statusLine formats the start line of a response, e.g.
+// "HTTP/1.1 200 OK".
+func statusLine(version string, code int) string {
+	text, reason := status(code)
+	return version + " " + text + " " + reason
+}
+
 var (
 	protocol  string
 	host      string
 	port      string
 	directory string
+	noFiles   bool
+	indexFile string
+	favicon   string
+	notFound  string
+	router    *Router
+	tracker   = newConnTracker()
+
+	shutdownTimeout time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	maxBodySize     int64
+	maxHeaderBytes  int
+	maxURILength    int
+	strictHeaders   bool
+	serverName      string
+	tlsCert         string
+	tlsKey          string
+	maxConns        int
+	maxPipeline     int
+	connSlots       chan struct{}
+)
+
+var (
+	errMalformedRequest    = errors.New("malformed request")
+	errMalformedPath       = errors.New("malformed percent-encoding in path")
+	errBodyTooLarge        = errors.New("request body too large")
+	errVersionNotSupported = errors.New("HTTP version not supported")
+	errHeaderTooLarge      = errors.New("request header section too large")
+	errURITooLong          = errors.New("request URI too long")
+	errRequestTimeout      = errors.New("request timeout")
+	errInvalidRange        = errors.New("invalid range")
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+	errNotImplemented      = errors.New("not implemented")
 )
 
 func main() {
 	parseEnv()
-	l, err := net.Listen(protocol, fmt.Sprintf("%s:%s", host, port))
+	if checkOnly {
+		os.Exit(runChecks())
+	}
+	router = setupRouter()
+	if accessLogPath != "" {
+		l, err := openAccessLog(accessLogPath)
+		if err != nil {
+			fmt.Println("Failed to open access log: ", err.Error())
+			os.Exit(1)
+		}
+		accessLog = l
+	}
+	var listeners []net.Listener
+	ports := strings.Split(port, ",")
+	if protocol == "unix" {
+		ports = ports[:1]
+	}
+	for _, p := range ports {
+		p = strings.TrimSpace(p)
+		l, err := listen(p)
+		if err != nil {
+			fmt.Printf("Failed to bind to port %s: %s\n", p, err.Error())
+			os.Exit(1)
+		}
+		if tlsCert != "" || tlsKey != "" {
+			l, err = tlsListener(l)
+			if err != nil {
+				fmt.Println("Failed to set up TLS: ", err.Error())
+				os.Exit(1)
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case sig := <-signals:
+			fmt.Printf("Received %s, shutting down\n", sig)
+		case <-shutdownCh:
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if cacheSize > 0 {
+		cache = newFileCache(cacheSize)
+	}
+	if rateLimit > 0 {
+		rateLimiter = newIPRateLimiter(rateLimit, rateBurst)
+		go rateLimiter.runCleanup(time.Minute)
+	}
+	if maxConns > 0 {
+		connSlots = make(chan struct{}, maxConns)
+	}
+	var loops sync.WaitGroup
+	for _, l := range listeners {
+		loops.Add(1)
+		go func(l net.Listener) {
+			defer loops.Done()
+			acceptConnections(l)
+		}(l)
+	}
+	loops.Wait()
+	open := tracker.shutdown()
+	if tracker.wait(shutdownTimeout) {
+		fmt.Printf("Drained %d connections\n", open)
+	} else {
+		fmt.Printf("Shutdown timeout of %s hit while draining %d connections\n", shutdownTimeout, open)
+	}
+}
+
+// listen binds the configured protocol on host and port p. For the
+// unix protocol host is the socket path and p is ignored; a stale
+// socket left behind by a previous run is removed first. The socket
+// file is removed again when the listener is closed.
+func listen(p string) (net.Listener, error) {
+	if protocol != "unix" {
+		return net.Listen(protocol, fmt.Sprintf("%s:%s", host, p))
+	}
+	if err := removeStaleSocket(host); err != nil {
+		return nil, err
+	}
+	return net.Listen(protocol, host)
+}
+
+// removeStaleSocket deletes the unix socket at path unless a server is
+// still accepting connections on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		fmt.Println("Failed to bind to port ", port)
-		os.Exit(1)
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
 	}
+	return os.Remove(path)
+}
+
+// acceptConnections hands every connection accepted on l to its own
+// handleConnection goroutine until l is closed.
+func acceptConnections(l net.Listener) {
 	for {
+		acquireConnSlot()
 		conn, err := l.Accept()
 		if err != nil {
+			releaseConnSlot()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("Error accepting connection: ", err.Error())
 			continue
 		}
+		tracker.add(conn)
 		go handleConnection(conn)
 	}
 }
 
-type headers map[string]string
+type headers map[string][]string
+
+// Get returns the first value stored for key.
+func (h headers) Get(key string) string {
+	if values := h[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h headers) Set(key string, value string) {
+	h[key] = []string{value}
+}
+
+func (h headers) Add(key string, value string) {
+	h[key] = append(h[key], value)
+}
+
+func (h headers) Del(key string) {
+	delete(h, key)
+}
 
 type request struct {
-	method  string
-	path    string
-	version string
-	headers headers
-	body    string
+	method     string
+	path       string
+	rawPath    string
+	version    string
+	headers    headers
+	body       string
+	params     map[string]string
+	rawQuery   string
+	query      map[string][]string
+	form       *formCache
+	id         string
+	head       string
+	host       string
+	remoteAddr string
 }
 
 func (r request) IsGet() bool {
@@ -62,163 +327,1729 @@ func (r request) IsPost() bool {
 	return r.method == "POST"
 }
 
+func (r request) IsPut() bool {
+	return r.method == "PUT"
+}
+
+func (r request) IsHead() bool {
+	return r.method == "HEAD"
+}
+
+func (r request) IsOptions() bool {
+	return r.method == "OPTIONS"
+}
+
+func (r request) IsDelete() bool {
+	return r.method == "DELETE"
+}
+
+func (r request) IsPatch() bool {
+	return r.method == "PATCH"
+}
+
+func (r request) IsTrace() bool {
+	return r.method == "TRACE"
+}
+
+// Header returns the value of the named request header, matching the
+// name case-insensitively.
+func (r request) Header(name string) string {
+	return r.headers.Get(textproto.CanonicalMIMEHeaderKey(name))
+}
+
+// HeaderValues returns every value sent for the named request header.
+func (r request) HeaderValues(name string) []string {
+	return r.headers[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// IsChunked reports whether the request body uses the chunked
+// transfer coding.
+func (r request) IsChunked() bool {
+	for _, coding := range strings.Split(r.Header("Transfer-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(coding), "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r request) ExpectsContinue() bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header("Expect")), "100-continue")
+}
+
+func (r request) Query(key string) string {
+	if values := r.query[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// KeepAlive reports whether the connection may be reused after r. The
+// Connection header is a list of options, possibly spread over several
+// fields, such as "close, TE" or "keep-alive, Upgrade".
+func (r request) KeepAlive() bool {
+	connection := strings.Join(r.HeaderValues("Connection"), ",")
+	if r.version == "HTTP/1.0" {
+		return headerHasToken(connection, "keep-alive")
+	}
+	return !headerHasToken(connection, "close")
+}
+
 type response struct {
-	status  string
-	headers headers
-	content string
+	statusCode int
+	reason     string
+	version    string
+	headers    headers
+	content    []byte
+	bodyReader io.ReadCloser
+	omitBody   bool
+	// flush streams the body, flushing every write from bodyReader to
+	// the client as it happens.
+	flush bool
+	// upgrade takes over the connection once a 101 response has been
+	// written, reading from the connection buffer and writing to w.
+	upgrade func(r *bufio.Reader, w io.Writer)
+}
+
+// startLine formats the response start line from the status code,
+// using the table reason unless one was set and HTTP/1.1 unless the
+// version was negotiated down.
+func (res response) startLine() string {
+	version := res.version
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	code, reason := status(res.statusCode)
+	if res.reason != "" {
+		reason = res.reason
+	}
+	return version + " " + code + " " + reason
+}
+
+func (res *response) SetHeader(key string, value string) {
+	if res.headers == nil {
+		res.headers = make(headers, 1)
+	}
+	res.headers.Set(key, value)
+}
+
+func (res *response) AddHeader(key string, value string) {
+	if res.headers == nil {
+		res.headers = make(headers, 1)
+	}
+	res.headers.Add(key, value)
 }
 
-func (res response) WriteToConn(conn net.Conn) error {
-	_, err := conn.Write([]byte(fmt.Sprintf("%s\r\n", res.status)))
+// WriteToConn writes the response through a buffered writer and
+// flushes it once at the end, so a small response leaves in a single
+// write instead of one per header line. It returns the number of body
+// bytes written, before any chunked framing.
+func (res response) WriteToConn(conn io.Writer) (int64, error) {
+	if res.bodyReader != nil {
+		defer res.bodyReader.Close()
+	}
+	w := bufio.NewWriter(conn)
+	n, err := res.write(w)
 	if err != nil {
-		return err
+		return n, err
 	}
-	for k, v := range res.headers {
-		_, err := conn.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
-		if err != nil {
-			return err
+	return n, w.Flush()
+}
+
+func (res response) write(conn io.Writer) (int64, error) {
+	_, err := conn.Write([]byte(res.startLine() + "\r\n"))
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := res.headers["Date"]; !ok {
+		if _, err := conn.Write([]byte("Date: " + now().UTC().Format(TimeFormat) + "\r\n")); err != nil {
+			return 0, err
+		}
+	}
+	if _, ok := res.headers["Server"]; !ok && serverName != "" {
+		if _, err := conn.Write([]byte("Server: " + serverName + "\r\n")); err != nil {
+			return 0, err
+		}
+	}
+	for k, values := range res.headers {
+		for _, v := range values {
+			_, err := conn.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
+			if err != nil {
+				return 0, err
+			}
 		}
 	}
 	_, err = conn.Write([]byte("\r\n"))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if res.omitBody {
+		return 0, nil
 	}
-	if len(res.content) > 0 {
-		_, err := conn.Write([]byte(fmt.Sprintf("%s\r\n", res.content)))
+	if res.bodyReader != nil && res.headers.Get("Transfer-Encoding") == "chunked" {
+		cw := chunkedWriter{w: conn}
+		n, err := io.Copy(res.bodyWriter(cw, conn), res.bodyReader)
 		if err != nil {
-			return err
+			return n, err
 		}
+		return n, cw.Close()
 	}
-	return nil
+	if res.bodyReader != nil {
+		return io.Copy(res.bodyWriter(conn, conn), res.bodyReader)
+	}
+	n, err := conn.Write(res.content)
+	return int64(n), err
+}
+
+// bodyWriter returns w, wrapped to flush conn after every write when
+// res.flush asks for the body to be streamed unbuffered.
+func (res response) bodyWriter(w io.Writer, conn io.Writer) io.Writer {
+	if buf, ok := conn.(*bufio.Writer); ok && res.flush {
+		return flushWriter{w: w, buf: buf}
+	}
+	return w
+}
+
+// flushWriter flushes buf after every write to w, so each piece of a
+// streamed body reaches the client as soon as it is produced.
+type flushWriter struct {
+	w   io.Writer
+	buf *bufio.Writer
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.buf.Flush()
+}
+
+// deadlineWriter pushes the write deadline of conn forward before
+// every write, so that -write-timeout bounds each write of a
+// long-lived stream instead of the stream as a whole.
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (dw deadlineWriter) Write(p []byte) (int, error) {
+	dw.conn.SetWriteDeadline(deadline(writeTimeout))
+	return dw.conn.Write(p)
+}
+
+// chunkedWriter frames every Write as a single chunk of the chunked
+// transfer coding. Close writes the terminating zero-length chunk.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (cw chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = cw.w.Write([]byte("\r\n"))
+	return n, err
+}
+
+func (cw chunkedWriter) Close() error {
+	_, err := cw.w.Write([]byte("0\r\n\r\n"))
+	return err
 }
 
 func parseEnv() {
 	flag.StringVar(&protocol, "protocol", "tcp", "protocol to use")
 	flag.StringVar(&host, "host", "0.0.0.0", "host to use")
-	flag.StringVar(&port, "port", "4221", "port to use")
+	flag.StringVar(&port, "port", "4221", "port to use, or a comma-separated list of ports")
 	flag.StringVar(&directory, "directory", "", "dir with files to serve")
+	flag.BoolVar(&noFiles, "no-files", false, "never serve or write files, regardless of -directory, -mount and -index")
+	flag.StringVar(&indexFile, "index", "", "file inside -directory served at /")
+	flag.StringVar(&favicon, "favicon", "", "icon file served at /favicon.ico")
+	flag.StringVar(&notFound, "notfound-file", "", "HTML file served as the body of 404 responses")
+	flag.DurationVar(&readTimeout, "read-timeout", 30*time.Second, "max time to read a request, 0 means no timeout")
+	flag.DurationVar(&writeTimeout, "write-timeout", 30*time.Second, "max time to write a response, 0 means no timeout")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "max time a kept-alive connection may wait for its next request, 0 uses -read-timeout")
+	flag.IntVar(&maxURILength, "max-uri-length", 8192, "max length of the request target in bytes, 0 means no limit")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", 1<<20, "max size of the request line and headers in bytes, 0 means no limit")
+	flag.Int64Var(&maxBodySize, "max-body-size", 10<<20, "max request body size in bytes, 0 means no limit")
+	flag.StringVar(&serverName, "server-name", "codecrafters-http/1.0", "value of the Server response header, empty to omit it")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, serves HTTPS together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file, serves HTTPS together with -tls-cert")
+	flag.Int64Var(&cacheSize, "cache-size", 0, "bytes of file content to keep cached in memory, 0 disables the cache")
+	flag.IntVar(&maxPipeline, "max-pipeline", 0, "max requests served on one connection before it is closed, 0 means no limit")
+	flag.IntVar(&maxConns, "max-conns", 0, "max concurrent connections, 0 means no limit")
+	flag.Float64Var(&rateLimit, "rate", 0, "requests per second allowed per client IP, 0 means no limit")
+	flag.IntVar(&rateBurst, "burst", 10, "requests a client IP may make at once before -rate applies")
+	flag.StringVar(&authUser, "auth-user", "", "Basic auth user required for /files/")
+	flag.StringVar(&authPass, "auth-pass", "", "Basic auth password required for /files/")
+	cors := flag.String("cors-origins", "", "comma-separated origins allowed for CORS, or * for any")
+	flag.Var(&mounts, "mount", "directory served under a URL prefix, of the form /prefix=/dir, may be repeated")
+	flag.Var(vhosts, "vhost", "directory served for a Host, of the form host=/dir, may be repeated")
+	flag.Var(&proxies, "proxy", "URL prefix forwarded to an upstream, of the form /prefix=http://host:port, may be repeated")
+	flag.Var(redirects, "redirect", "permanent redirect of the form /from=/to, may be repeated")
+	flag.BoolVar(&strictSlash, "strict-slash", false, "redirect paths with a superfluous trailing slash instead of serving them")
+	flag.BoolVar(&strictHeaders, "strict-headers", false, "reject requests with folded header lines instead of joining them")
+	flag.BoolVar(&disableTrace, "disable-trace", false, "answer TRACE requests with 405 instead of reflecting them")
+	flag.BoolVar(&enableAdmin, "enable-admin", false, "serve POST /admin/shutdown, guarded by -auth-user and -auth-pass")
+	flag.BoolVar(&enableDebug, "enable-debug", false, "serve GET /debug/requests listing the most recent requests")
+	flag.IntVar(&debugBuffer, "debug-buffer", 100, "number of recent requests kept for /debug/requests")
+	flag.BoolVar(&quiet, "quiet", false, "suppress per-request logs")
+	flag.StringVar(&logFormat, "log-format", "text", "format of per-request logs, text or json")
+	flag.Float64Var(&logSample, "log-sample", 1, "fraction of 2xx requests logged, between 0 and 1; other responses are always logged")
+	flag.StringVar(&accessLogPath, "access-log", "", "file to append Common Log Format access logs to")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "time to wait for connections to drain on shutdown, 0 waits forever")
+	flag.BoolVar(&checkOnly, "check", false, "validate the configuration, print a summary and exit without serving")
+	flag.StringVar(&configPath, "config", "", "JSON file with flag values, overridden by flags given on the command line")
 	flag.Parse()
-	fmt.Printf("Listening at %s://%s:%s and serving directory %q\n", protocol, host, port, directory)
+	if configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err == nil {
+			err = cfg.apply(flag.CommandLine)
+		}
+		if err != nil {
+			fmt.Println("Failed to load config: ", err.Error())
+			os.Exit(1)
+		}
+	}
+	corsOrigins = parseCORSOrigins(*cors)
+	if logFormat != "text" && logFormat != "json" {
+		fmt.Printf("Invalid -log-format %q, must be text or json\n", logFormat)
+		os.Exit(1)
+	}
+	if enableAdmin && (authUser == "" || authPass == "") {
+		fmt.Println("-enable-admin requires -auth-user and -auth-pass, or anyone could shut the server down")
+		os.Exit(1)
+	}
+	if logSample < 0 || logSample > 1 {
+		fmt.Printf("Invalid -log-sample %v, must be between 0 and 1\n", logSample)
+		os.Exit(1)
+	}
+	if !checkOnly {
+		fmt.Printf("Listening at %s://%s:%s and serving directory %q\n", protocol, host, port, directory)
+	}
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	req, err := connectionToRequest(conn)
+// tlsListener wraps l so that accepted connections are served over
+// TLS using the configured certificate and key.
+func tlsListener(l net.Listener) (net.Listener, error) {
+	if tlsCert == "" || tlsKey == "" {
+		return nil, errors.New("both -tls-cert and -tls-key must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 	if err != nil {
-		fmt.Println("Error parsing connection as request: ", err.Error())
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}
+
+// acquireConnSlot blocks until fewer than -max-conns connections are
+// being handled. It is a no-op when there is no limit.
+func acquireConnSlot() {
+	if connSlots == nil {
 		return
 	}
-	res := response{}
-	switch {
-	case req.IsGet():
-		handleGetRequest(req, &res)
-	case req.IsPost():
-		handlePostRequest(req, &res)
+	select {
+	case connSlots <- struct{}{}:
 	default:
-		res.status = ResponseNotFound
+		fmt.Printf("Connection limit of %d reached, waiting for a free slot\n", maxConns)
+		connSlots <- struct{}{}
+	}
+}
+
+func releaseConnSlot() {
+	if connSlots != nil {
+		<-connSlots
+	}
+}
+
+// handleConnection serves requests on conn until the client or the
+// server closes it. Every request is parsed from the same buffered
+// reader, so bytes of a pipelined request that arrived together with
+// the previous one stay buffered and responses go out in request
+// order. After -max-pipeline requests the connection is closed with
+// the last response, so one client cannot hold it forever.
+func handleConnection(conn net.Conn) {
+	metrics.activeConnections.Add(1)
+	defer metrics.activeConnections.Add(-1)
+	defer releaseConnSlot()
+	defer tracker.done(conn)
+	defer conn.Close()
+	// dispatch recovers handler panics with a 500; this catches the
+	// rest, from parsing, writing or an upgraded protocol, so that one
+	// connection cannot take the server down.
+	defer func() {
+		if v := recover(); v != nil {
+			fmt.Printf("Panic on connection from %s: %v\n%s", conn.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+	reader := bufio.NewReader(conn)
+	for served := 1; ; served++ {
+		// Between keep-alive requests the connection may idle for
+		// -idle-timeout; once a request starts it must arrive within
+		// -read-timeout.
+		wait := readTimeout
+		if served > 1 && idleTimeout > 0 {
+			wait = idleTimeout
+		}
+		conn.SetReadDeadline(deadline(wait))
+		// A pipelined request already sitting in the buffer means the
+		// connection is not idle, so shutdown must let it be served.
+		if reader.Buffered() == 0 {
+			if !tracker.setIdle(conn, true) {
+				return
+			}
+			_, err := reader.Peek(1)
+			tracker.setIdle(conn, false)
+			if err != nil {
+				return
+			}
+		}
+		conn.SetReadDeadline(deadline(readTimeout))
+		// The previous response's write deadline may have passed while
+		// the connection idled; a 100 Continue needs a fresh one.
+		conn.SetWriteDeadline(deadline(writeTimeout))
+		start := time.Now()
+		req, err := connectionToRequest(reader, conn)
+		if err != nil {
+			if status, ok := parseErrorStatus(err); ok {
+				// A rejected request is still a response sent, so it is
+				// counted and logged with whatever of the request was
+				// parsed before the error.
+				req.remoteAddr = conn.RemoteAddr().String()
+				res := response{}
+				responseError(req, &res, status, err.Error())
+				res.SetHeader("Connection", "close")
+				conn.SetWriteDeadline(deadline(writeTimeout))
+				cw := &countingWriter{w: conn}
+				body, _ := res.WriteToConn(cw)
+				metrics.recordResponse(res.statusCode, cw.n)
+				recentRequests.record(req, res, start)
+				logRequest(conn, req, res, start, body)
+			}
+			if !errors.Is(err, io.EOF) {
+				fmt.Println("Error parsing connection as request: ", err.Error())
+			}
+			return
+		}
+		req.id = requestID(req)
+		req.remoteAddr = conn.RemoteAddr().String()
+		res, recovered := dispatch(req)
+		// Only a GET can switch protocols. A HEAD answered by the GET
+		// handler must not hand over the connection, so it is told which
+		// protocol to upgrade to instead, as a GET without the upgrade
+		// headers would be.
+		if res.upgrade != nil && req.IsHead() {
+			res = response{statusCode: ResponseUpgradeRequired, headers: headers{"Upgrade": res.headers["Upgrade"]}}
+		}
+		res.version = req.version
+		applyNotFoundPage(&res)
+		applyErrorBody(req, &res)
+		applyCORS(req, &res)
+		// Whichever handler answered, a HEAD response has no body.
+		if req.IsHead() {
+			res.omitBody = true
+		}
+		res.SetHeader("X-Request-Id", req.id)
+		if res.upgrade != nil {
+			conn.SetWriteDeadline(deadline(writeTimeout))
+			_, err = res.WriteToConn(conn)
+			metrics.recordResponse(res.statusCode, 0)
+			recentRequests.record(req, res, start)
+			logRequest(conn, req, res, start, 0)
+			if err == nil {
+				conn.SetDeadline(time.Time{})
+				res.upgrade(reader, conn)
+			}
+			return
+		}
+		if _, ok := res.headers["Content-Length"]; !ok && res.bodyReader == nil && res.statusCode != ResponseNoContent && res.statusCode != ResponseNotModified {
+			res.SetHeader("Content-Length", fmt.Sprint(len(res.content)))
+		}
+		keepAlive := !recovered && req.KeepAlive() && !tracker.closingDown() && (maxPipeline <= 0 || served < maxPipeline)
+		// HTTP/1.0 has no chunked coding, so a body of unknown length
+		// is sent as is and delimited by closing the connection.
+		if req.version == "HTTP/1.0" && res.headers.Get("Transfer-Encoding") == "chunked" {
+			res.headers.Del("Transfer-Encoding")
+			keepAlive = false
+		}
+		if keepAlive {
+			res.SetHeader("Connection", "keep-alive")
+		} else {
+			res.SetHeader("Connection", "close")
+		}
+		conn.SetWriteDeadline(deadline(writeTimeout))
+		cw := &countingWriter{w: conn}
+		if res.flush {
+			cw.w = deadlineWriter{conn}
+		}
+		body, err := res.WriteToConn(cw)
+		metrics.recordResponse(res.statusCode, cw.n)
+		recentRequests.record(req, res, start)
+		logRequest(conn, req, res, start, body)
+		if err != nil {
+			fmt.Println("Error responding to request: ", err.Error())
+			return
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// dispatch runs the handler for req. A panicking handler is recovered
+// with its stack logged, and a 500 is returned in place of whatever it
+// had written so far; recovered reports that this happened so the
+// connection can be closed.
+func dispatch(req request) (res response, recovered bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			fmt.Printf("Panic serving %s %s: %v\n%s", req.method, req.path, v, debug.Stack())
+			if res.bodyReader != nil {
+				res.bodyReader.Close()
+			}
+			res = response{statusCode: ResponseInternalError}
+			recovered = true
+		}
+	}()
+	if rateLimiter != nil {
+		if ok, wait := rateLimiter.allow(remoteIP(req.remoteAddr)); !ok {
+			handleTooManyRequests(&res, wait)
+			return res, false
+		}
+	}
+	if req.IsTrace() && !disableTrace {
+		handleTrace(req, &res)
+	} else {
+		router.ServeRequest(req, &res)
+	}
+	return res, false
+}
+
+// parseErrorStatus maps errors from connectionToRequest that the
+// client should be told about to a response status.
+func parseErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, errMalformedRequest), errors.Is(err, errMalformedPath):
+		return ResponseBadRequest, true
+	case errors.Is(err, errBodyTooLarge):
+		return ResponsePayloadTooLarge, true
+	case errors.Is(err, errRequestTimeout):
+		return ResponseRequestTimeout, true
+	case errors.Is(err, errURITooLong):
+		return ResponseURITooLong, true
+	case errors.Is(err, errHeaderTooLarge):
+		return ResponseHeaderFieldsTooLarge, true
+	case errors.Is(err, errVersionNotSupported):
+		return ResponseVersionNotSupported, true
+	case errors.Is(err, errNotImplemented):
+		return ResponseNotImplemented, true
+	}
+	return 0, false
+}
+
+// applyNotFoundPage fills an empty 404 response with the -notfound-file
+// page. The bare 404 is kept when the page cannot be read.
+func applyNotFoundPage(res *response) {
+	if notFound == "" || res.statusCode != ResponseNotFound || len(res.content) > 0 || res.bodyReader != nil {
+		return
 	}
-	err = res.WriteToConn(conn)
+	content, err := os.ReadFile(notFound)
 	if err != nil {
-		fmt.Println("Error responding to request: ", err.Error())
+		fmt.Println("Error reading not found page: ", err.Error())
+		return
+	}
+	responseContent(res, content, TypeTextHTML)
+	res.statusCode = ResponseNotFound
+}
+
+// applyErrorBody gives an error response that a handler or the router
+// left empty the body responseError would have written, naming the
+// status in text or JSON as the client prefers.
+func applyErrorBody(req request, res *response) {
+	if res.statusCode < 400 || len(res.content) > 0 || res.bodyReader != nil {
+		return
+	}
+	if _, ok := res.headers["Content-Type"]; ok {
+		return
+	}
+	if _, ok := res.headers["Content-Length"]; ok {
 		return
 	}
+	responseError(req, res, res.statusCode, strings.ToLower(statusReasons[res.statusCode]))
+}
+
+// deadline returns the point in time timeout from now, or the zero
+// time for no deadline when timeout is not positive.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
 }
 
-func connectionToRequest(conn net.Conn) (req request, err error) {
-	buf := make([]byte, 32<<8)
-	_, err = conn.Read(buf)
+// readHeaderSection reads header lines up to and including the empty
+// line ending them, adding to the running size checked by
+// readHeaderLine. A stream ending before that line is malformed.
+func readHeaderSection(reader *bufio.Reader, size *int) ([]byte, error) {
+	var headerBytes []byte
+	for !bytes.HasSuffix(headerBytes, []byte("\r\n\r\n")) && !bytes.Equal(headerBytes, []byte("\r\n")) {
+		line, err := readHeaderLine(reader, size)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w: headers delimiter not found", errMalformedRequest)
+			}
+			return nil, err
+		}
+		headerBytes = append(headerBytes, line...)
+	}
+	return headerBytes, nil
+}
+
+// connectionToRequest reads the next request from reader. Interim
+// responses such as 100 Continue are written to w. Reads wait for
+// slow clients until the connection read deadline, after which
+// errRequestTimeout is returned.
+//
+// The body is consumed exactly to its Content-Length or terminating
+// chunk, never further: reader is the connection's only buffered
+// reader and is reused for the next request, so bytes of a following
+// keep-alive or pipelined request stay in its buffer for the next call.
+// After an error the position in the stream is unknown and the caller
+// must close the connection.
+func connectionToRequest(reader *bufio.Reader, w io.Writer) (req request, err error) {
+	defer func() {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("%w: request not received within %s", errRequestTimeout, readTimeout)
+		}
+	}()
+	headerSize := 0
+	startLine, err := readHeaderLine(reader, &headerSize)
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(startLine) > 0 {
+			return req, fmt.Errorf("%w: start line delimiter not found", errMalformedRequest)
+		}
+		return req, err
+	}
+	err = parseStartline(bytes.TrimSuffix(startLine, []byte("\r\n")), &req)
+	if err != nil {
+		return req, err
+	}
+	headerBytes, err := readHeaderSection(reader, &headerSize)
+	if err != nil {
+		return req, err
+	}
+	if err := parseHeaderLines(headerBytes, &req); err != nil {
+		return req, err
+	}
+	if hosts := req.HeaderValues("Host"); len(hosts) > 1 {
+		return req, fmt.Errorf("%w: multiple Host headers", errMalformedRequest)
+	} else if len(hosts) == 1 {
+		req.host = strings.TrimSpace(hosts[0])
+	} else if req.version != "HTTP/1.0" {
+		return req, fmt.Errorf("%w: missing Host header", errMalformedRequest)
+	}
+	req.head = string(startLine) + string(headerBytes)
+	if len(req.HeaderValues("Transfer-Encoding")) > 0 && req.Header("Content-Length") != "" {
+		return req, fmt.Errorf("%w: both Transfer-Encoding and Content-Length present", errMalformedRequest)
+	}
+	if err := checkTransferEncoding(req); err != nil {
+		return req, err
+	}
+	length, err := contentLength(req)
 	if err != nil {
 		return req, err
 	}
-	startLineEndIdx := strings.Index(string(buf), "\r\n")
-	if startLineEndIdx < 0 {
-		return req, errors.New("start line delimiter not found")
+	// HTTP/1.0 has no interim responses, so the expectation is ignored.
+	// A failed write is not a read timeout and must not become a 408.
+	if req.ExpectsContinue() && req.version != "HTTP/1.0" && (req.IsChunked() || length > 0) {
+		if _, err := w.Write([]byte(statusLine(req.version, ResponseContinue) + "\r\n\r\n")); err != nil {
+			return req, fmt.Errorf("writing 100 Continue: %v", err)
+		}
 	}
-	headersEndIdx := strings.Index(string(buf), "\r\n\r\n")
-	if headersEndIdx < 0 {
-		return req, errors.New("headers delimiter not found")
+	var body []byte
+	if req.IsChunked() {
+		body, err = readChunkedBody(reader)
+	} else {
+		body, err = readBody(reader, length)
 	}
-	err = parseStartline(buf[:startLineEndIdx+2], &req)
 	if err != nil {
 		return req, err
 	}
-	parseHeaderLines(buf[startLineEndIdx+2:headersEndIdx+4], &req)
-	req.body = string(bytes.Trim(buf[headersEndIdx+4:], "\x00"))
+	if strings.EqualFold(strings.TrimSpace(req.Header("Content-Encoding")), EncodingGzip) {
+		if body, err = decompressBody(body); err != nil {
+			return req, err
+		}
+		req.headers.Del("Content-Encoding")
+		req.headers.Set("Content-Length", fmt.Sprint(len(body)))
+	}
+	req.body = string(body)
+	req.form = &formCache{}
 	return req, nil
 }
 
-func parseStartline(startLine []byte, req *request) error {
-	startLines := strings.Split(string(startLine), " ")
-	if len(startLines) != 3 {
-		return errors.New("HTTP startline should contain METHOD PATH VERSION")
+// checkTransferEncoding accepts a request without Transfer-Encoding or
+// with chunked as its only coding. Without chunked as the final coding
+// the body has no length the server could read it to, so the request
+// is malformed; any other coding is one the server does not implement.
+func checkTransferEncoding(req request) error {
+	values := req.HeaderValues("Transfer-Encoding")
+	if len(values) == 0 {
+		return nil
+	}
+	codings := strings.Split(strings.Join(values, ","), ",")
+	for i, coding := range codings {
+		coding = strings.TrimSpace(coding)
+		chunked := strings.EqualFold(coding, "chunked")
+		if last := i == len(codings)-1; last != chunked {
+			return fmt.Errorf("%w: Transfer-Encoding %q must end in a single chunked", errMalformedRequest, strings.Join(values, ", "))
+		}
+		if !chunked {
+			return fmt.Errorf("%w: transfer coding %q", errNotImplemented, coding)
+		}
 	}
-	req.method = startLines[0]
-	req.path = startLines[1]
-	req.version = startLines[2]
 	return nil
 }
 
-func parseHeaderLines(headerBytes []byte, req *request) {
-	headerLines := strings.Split(string(headerBytes), "\r\n")
-	if req.headers == nil {
-		req.headers = make(headers, len(headerLines))
-	}
-	for _, line := range headerLines {
-		splittedLine := strings.Split(line, ": ")
-		if len(splittedLine) == 2 {
-			req.headers[splittedLine[0]] = splittedLine[1]
+// readHeaderLine reads up to and including the next newline, adding
+// the bytes read to size and failing with errHeaderTooLarge once size
+// exceeds -max-header-bytes. A line longer than the reader's buffer is
+// collected one buffer at a time, so memory grows with the header
+// section instead of being sized for the largest request up front.
+func readHeaderLine(reader *bufio.Reader, size *int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		*size += len(chunk)
+		if maxHeaderBytes > 0 && *size > maxHeaderBytes {
+			return nil, fmt.Errorf("%w: exceeds limit of %d bytes", errHeaderTooLarge, maxHeaderBytes)
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
 		}
 	}
 }
 
-func handleGetRequest(req request, res *response) {
-	if req.path == "/" {
-		res.status = ResponseOK
-		return
-	}
-	if req.path == "/user-agent" {
-		responseContent(res, req.headers["User-Agent"], TypeTextPlain)
-		return
+// contentLength validates the Content-Length header of req against
+// -max-body-size and returns 0 when it is absent.
+func contentLength(req request) (int64, error) {
+	value := req.Header("Content-Length")
+	if value == "" {
+		return 0, nil
 	}
-	if p, ok := strings.CutPrefix(req.path, "/echo/"); ok {
-		responseContent(res, p, TypeTextPlain)
-		return
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("%w: invalid Content-Length %q", errMalformedRequest, value)
 	}
-	if p, ok := strings.CutPrefix(req.path, "/files/"); ok {
-		bytes, err := os.ReadFile(fmt.Sprintf("%s/%s", directory, p))
-		if err == nil {
-			responseContent(res, string(bytes), TypeOctetStream)
-			return
-		}
+	if maxBodySize > 0 && length > maxBodySize {
+		return 0, fmt.Errorf("%w: %d bytes exceeds limit of %d", errBodyTooLarge, length, maxBodySize)
 	}
-	res.status = ResponseNotFound
+	return length, nil
 }
 
-func handlePostRequest(req request, res *response) {
-	if p, ok := strings.CutPrefix(req.path, "/files/"); ok {
-		file, err := os.Create(fmt.Sprintf("%s/%s", directory, p))
-		if err != nil {
-			res.status = ResponseInternalError
-			return
-		}
-		defer file.Close()
-		_, err = io.Copy(file, strings.NewReader(req.body))
-		if err != nil {
-			res.status = ResponseInternalError
-			return
+// readBody reads exactly length bytes of body from reader, leaving
+// whatever follows unread. A connection closed before length bytes
+// arrive is a malformed request rather than a short body. The buffer
+// grows as bytes arrive rather than being sized by the claimed length,
+// so a huge Content-Length costs nothing until the body is really sent.
+func readBody(reader io.Reader, length int64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	var body bytes.Buffer
+	if n, err := io.CopyN(&body, reader, length); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: connection closed after %d of %d body bytes", errMalformedRequest, n, length)
 		}
-		res.status = ResponseCreated
-		return
+		return nil, err
 	}
-	res.status = ResponseNotFound
+	return body.Bytes(), nil
 }
 
-func responseContent(res *response, content string, contentType string) {
-	if res.headers == nil {
+// decompressBody inflates a gzip request body. The limit of
+// -max-body-size applies to the decompressed size, so a small
+// compressed body cannot expand without bound.
+func decompressBody(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid gzip body: %s", errMalformedRequest, err.Error())
+	}
+	defer zr.Close()
+	var r io.Reader = zr
+	if maxBodySize > 0 {
+		r = io.LimitReader(zr, maxBodySize+1)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid gzip body: %s", errMalformedRequest, err.Error())
+	}
+	if maxBodySize > 0 && int64(len(plain)) > maxBodySize {
+		return nil, fmt.Errorf("%w: decompressed body exceeds limit of %d", errBodyTooLarge, maxBodySize)
+	}
+	return plain, nil
+}
+
+// maxChunkLineBytes bounds a chunk-size line including any chunk
+// extensions, which are read and discarded.
+const maxChunkLineBytes = 4096
+
+// readChunkedBody decodes a chunked transfer-coded body. Chunk
+// extensions and trailer fields are read and discarded; the trailer
+// section counts against -max-header-bytes like the headers do. Each
+// chunk is copied as its bytes arrive, so a claimed chunk size is
+// never allocated up front.
+func readChunkedBody(reader *bufio.Reader) ([]byte, error) {
+	var body bytes.Buffer
+	for {
+		line, err := readChunkLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		sizeField, _, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: invalid chunk size %q", errMalformedRequest, line)
+		}
+		if size == 0 {
+			break
+		}
+		if maxBodySize > 0 && size > maxBodySize-int64(body.Len()) {
+			return nil, fmt.Errorf("%w: chunked body exceeds limit of %d", errBodyTooLarge, maxBodySize)
+		}
+		if _, err := io.CopyN(&body, reader, size); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w: connection closed inside chunk", errMalformedRequest)
+			}
+			return nil, err
+		}
+		crlf := make([]byte, 2)
+		if _, err := io.ReadFull(reader, crlf); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("%w: connection closed inside chunk", errMalformedRequest)
+			}
+			return nil, err
+		}
+		if !bytes.Equal(crlf, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: chunk not terminated by CRLF", errMalformedRequest)
+		}
+	}
+	trailerSize := 0
+	for {
+		line, err := readHeaderLine(reader, &trailerSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w: connection closed inside chunked body", errMalformedRequest)
+			}
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return body.Bytes(), nil
+		}
+	}
+}
+
+// readChunkLine reads a single CRLF terminated line of chunked
+// framing and returns it without the line ending. A line longer than
+// maxChunkLineBytes is malformed.
+func readChunkLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxChunkLineBytes {
+			return "", fmt.Errorf("%w: chunk size line exceeds %d bytes", errMalformedRequest, maxChunkLineBytes)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", fmt.Errorf("%w: connection closed inside chunked body", errMalformedRequest)
+			}
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+func parseStartline(startLine []byte, req *request) error {
+	startLines := strings.Split(string(startLine), " ")
+	if len(startLines) != 3 {
+		return fmt.Errorf("%w: HTTP startline should contain METHOD PATH VERSION", errMalformedRequest)
+	}
+	req.method = startLines[0]
+	if maxURILength > 0 && len(startLines[1]) > maxURILength {
+		return fmt.Errorf("%w: exceeds limit of %d bytes", errURITooLong, maxURILength)
+	}
+	rawPath, rawQuery, _ := strings.Cut(startLines[1], "?")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("%w: %q", errMalformedPath, rawPath)
+	}
+	req.path = path
+	req.rawPath = rawPath
+	req.rawQuery = rawQuery
+	req.version = startLines[2]
+	if err := validateVersion(req.version); err != nil {
+		return err
+	}
+	query, err := url.ParseQuery(req.rawQuery)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errMalformedRequest, err.Error())
+	}
+	req.query = query
+	return nil
+}
+
+// validateVersion accepts HTTP/1.0 and HTTP/1.1. Other well-formed
+// HTTP versions are unsupported, anything else is malformed.
+func validateVersion(version string) error {
+	switch version {
+	case "HTTP/1.0", "HTTP/1.1":
+		return nil
+	}
+	digits, ok := strings.CutPrefix(version, "HTTP/")
+	if ok && len(digits) == 3 && digits[1] == '.' && isDigit(digits[0]) && isDigit(digits[2]) {
+		return fmt.Errorf("%w: %s", errVersionNotSupported, version)
+	}
+	return fmt.Errorf("%w: invalid HTTP version %q", errMalformedRequest, version)
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// parseHeaderLines adds every "Name: value" line to req.headers. The
+// name ends at the first colon, so values may contain colons, and
+// surrounding whitespace is trimmed from the value. A line starting
+// with whitespace continues the previous field (obsolete folding) and
+// is joined onto its value with a single space, or rejected with
+// -strict-headers. Blank lines are skipped. A line without a colon or
+// with an empty name or whitespace in the name is malformed, since
+// RFC 7230 forbids guessing which field such a line was meant to be.
+func parseHeaderLines(headerBytes []byte, req *request) error {
+	headerLines := strings.Split(string(headerBytes), "\r\n")
+	if req.headers == nil {
+		req.headers = make(headers, len(headerLines))
+	}
+	last := ""
+	for _, line := range headerLines {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if strictHeaders {
+				return fmt.Errorf("%w: folded header line", errMalformedRequest)
+			}
+			if values := req.headers[last]; len(values) > 0 {
+				if cont := strings.Trim(line, " \t"); cont != "" {
+					values[len(values)-1] = strings.TrimRight(values[len(values)-1]+" "+cont, " ")
+				}
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("%w: invalid header line %q", errMalformedRequest, line)
+		}
+		last = textproto.CanonicalMIMEHeaderKey(name)
+		req.headers.Add(last, strings.Trim(value, " \t"))
+	}
+	return nil
+}
+
+func setupRouter() *Router {
+	rt := NewRouter()
+	rt.Handle("GET", "/healthz", handleHealth)
+	rt.Handle("GET", "/readyz", handleReady)
+	rt.Handle("GET", "/metrics", handleMetrics)
+	for from, to := range redirects {
+		rt.Handle("GET", from, redirectTo(to))
+	}
+	// parseEnv refuses -enable-admin without credentials; the route is
+	// still never registered unguarded.
+	if enableAdmin && authUser != "" && authPass != "" {
+		rt.Handle("POST", "/admin/shutdown", requireAuth(handleAdminShutdown))
+	}
+	if enableDebug {
+		recentRequests = newRequestRing(debugBuffer)
+		rt.Handle("GET", "/debug/requests", handleDebugRequests)
+	}
+	rt.Handle("GET", "/", handleIndex)
+	rt.Handle("GET", "/favicon.ico", handleFavicon)
+	rt.Handle("GET", "/user-agent", handleUserAgent)
+	rt.Handle("GET", "/echo/:msg", handleEcho)
+	rt.Handle("GET", "/ws", handleWebSocket)
+	rt.Handle("GET", "/events", handleEvents)
+	for _, p := range byPrefixLength(proxies) {
+		for _, method := range proxyMethods {
+			rt.Handle(method, strings.TrimSuffix(p.prefix, "/")+"/*path", handleProxy)
+		}
+	}
+	// With -no-files no route touching the filesystem is registered,
+	// so /files/ and mounts answer 404 for every method.
+	if noFiles {
+		return rt
+	}
+	for _, m := range byPrefixLength(mounts) {
+		rt.Handle("GET", strings.TrimSuffix(m.prefix, "/")+"/*name", handleMount)
+	}
+	rt.Handle("GET", "/files/*name", requireAuth(handleGetFile))
+	rt.Handle("POST", "/files/*name", requireAuth(handlePostFile))
+	rt.Handle("PUT", "/files/*name", requireAuth(handlePutFile))
+	rt.Handle("PATCH", "/files/*name", requireAuth(handlePatchFile))
+	rt.Handle("DELETE", "/files/*name", requireAuth(handleDeleteFile))
+	return rt
+}
+
+// handleIndex serves the -index file when it exists and otherwise
+// answers with an empty 200.
+func handleIndex(req request, res *response) {
+	if indexFile != "" && !noFiles {
+		if p, ok := resolveFilePath(req, indexFile); ok {
+			if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+				serveFile(req, res, rootFor(req), indexFile)
+				return
+			}
+		}
+	}
+	res.statusCode = ResponseOK
+}
+
+// handleFavicon serves the -favicon file, or an empty 204 when none is
+// configured so that browsers stop logging 404s for it.
+func handleFavicon(req request, res *response) {
+	if favicon == "" {
+		res.statusCode = ResponseNoContent
+		return
+	}
+	icon, err := os.ReadFile(favicon)
+	if err != nil {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	responseContent(res, icon, TypeIcon)
+}
+
+func handleHealth(req request, res *response) {
+	responseContent(res, []byte("ok"), TypeTextPlain)
+}
+
+// handleReady reports ready once the served directory, if any, can be
+// read.
+func handleReady(req request, res *response) {
+	if directory != "" && !noFiles {
+		if _, err := os.ReadDir(directory); err != nil {
+			responseError(req, res, ResponseServiceUnavailable, "directory unavailable")
+			return
+		}
+	}
+	responseContent(res, []byte("ok"), TypeTextPlain)
+}
+
+func handleUserAgent(req request, res *response) {
+	responseContent(res, []byte(req.Header("User-Agent")), TypeTextPlain)
+}
+
+func handleEcho(req request, res *response) {
+	responseContent(res, []byte(req.params["msg"]), TypeTextPlain)
+	encodeContent(res, negotiateEncoding(req))
+}
+
+func handleGetFile(req request, res *response) {
+	serveFile(req, res, rootFor(req), req.params["name"])
+}
+
+// serveFile answers req with the contents of name inside root,
+// honoring conditional, range and encoding headers.
+func serveFile(req request, res *response, root string, name string) {
+	p, ok := resolvePath(root, name)
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		res.statusCode = fileErrorStatus(err)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		res.statusCode = fileErrorStatus(err)
+		return
+	}
+	if info.IsDir() {
+		defer file.Close()
+		if !strings.HasSuffix(req.path, "/") {
+			res.statusCode = ResponseNotFound
+			return
+		}
+		entries, err := file.ReadDir(-1)
+		if err != nil {
+			res.statusCode = ResponseInternalError
+			return
+		}
+		responseContent(res, directoryListing(req.path, entries), TypeTextHTML)
+		return
+	}
+	etag, modTime := fileETag(info), info.ModTime()
+	// A precompressed sibling is a representation of its own, with its
+	// own entity tag and modification time, so it is picked before the
+	// validators are checked. Ranges always address the plain file.
+	var gz *os.File
+	var gzSize int64
+	encoding := ""
+	if req.Header("Range") == "" {
+		encoding = negotiateEncoding(req)
+	}
+	if encoding != "" {
+		if f, gzInfo, ok := openPrecompressed(p, info); ok {
+			gz, gzSize = f, gzInfo.Size()
+			etag, modTime = encodedETag(fileETag(gzInfo), encoding), gzInfo.ModTime()
+		} else if req.version == "HTTP/1.0" {
+			// Compressing on the fly has no known length, which
+			// HTTP/1.0 clients could only receive close-delimited.
+			encoding = ""
+		} else {
+			etag = encodedETag(etag, encoding)
+		}
+	}
+	res.SetHeader("Vary", "Accept-Encoding")
+	res.SetHeader("ETag", etag)
+	res.SetHeader("Last-Modified", modTime.UTC().Format(TimeFormat))
+	if req.Query("download") == "1" {
+		res.SetHeader("Content-Disposition", contentDisposition(filepath.Base(p)))
+	}
+	notModified := false
+	if inm := req.Header("If-None-Match"); inm != "" {
+		notModified = etagMatches(inm, etag)
+	} else if ims := req.Header("If-Modified-Since"); ims != "" {
+		notModified = notModifiedSince(ims, modTime)
+	}
+	if notModified {
+		file.Close()
+		if gz != nil {
+			gz.Close()
+		}
+		res.statusCode = ResponseNotModified
+		return
+	}
+	res.SetHeader("Accept-Ranges", "bytes")
+	if rangeHeader := req.Header("Range"); rangeHeader != "" && ifRangeMatches(req.Header("If-Range"), etag, info.ModTime()) {
+		size := info.Size()
+		start, end, err := parseByteRange(rangeHeader, size)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			file.Close()
+			res.statusCode = ResponseRangeNotSatisfiable
+			res.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return
+		}
+		if err == nil {
+			if _, err := file.Seek(start, io.SeekStart); err != nil {
+				file.Close()
+				res.statusCode = ResponseInternalError
+				return
+			}
+			length := end - start + 1
+			responseStream(res, struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(file, length), file}, length, contentTypeForPath(p))
+			res.statusCode = ResponsePartialContent
+			res.SetHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+			return
+		}
+	}
+	if gz != nil {
+		file.Close()
+		responseStream(res, gz, gzSize, contentTypeForPath(p))
+		res.SetHeader("Content-Encoding", encoding)
+		return
+	}
+	if cache != nil && info.Size() <= cache.budget {
+		defer file.Close()
+		content, ok := cache.get(p, encoding, info)
+		if !ok {
+			if content, err = io.ReadAll(file); err == nil && encoding != "" {
+				content, err = gzipContent(content)
+			}
+			if err != nil {
+				res.statusCode = ResponseInternalError
+				return
+			}
+			cache.put(p, encoding, info, content)
+		}
+		responseContent(res, content, contentTypeForPath(p))
+		if encoding != "" {
+			res.SetHeader("Content-Encoding", encoding)
+		}
+		return
+	}
+	if encoding != "" {
+		responseStream(res, gzipStream(file), -1, contentTypeForPath(p))
+		res.SetHeader("Content-Encoding", encoding)
+		return
+	}
+	responseStream(res, file, info.Size(), contentTypeForPath(p))
+}
+
+// contentDisposition asks the client to save the body as filename
+// rather than display it. The name comes from the request path, so
+// control characters are dropped to keep it from ending the header.
+// The quoted filename keeps only printable ASCII other than quote and
+// backslash, with underscores in place of the rest, and a name outside
+// ASCII is also sent in full as an RFC 6266 filename* parameter.
+func contentDisposition(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename)
+	var quoted strings.Builder
+	ascii := true
+	for _, r := range filename {
+		switch {
+		case r >= 0x80:
+			ascii = false
+			quoted.WriteByte('_')
+		case r == '"' || r == '\\':
+			quoted.WriteByte('_')
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+	header := "attachment; filename=\"" + quoted.String() + "\""
+	if !ascii {
+		header += "; filename*=UTF-8''" + extValueEscape(filename)
+	}
+	return header
+}
+
+// extValueEscape percent-encodes every byte of s outside the attr-char
+// set of RFC 5987.
+func extValueEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 && (isDigit(c) || c|0x20 >= 'a' && c|0x20 <= 'z' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// directoryListing renders entries, sorted by name, as an HTML page
+// linking each entry relative to urlPath.
+func directoryListing(urlPath string, entries []fs.DirEntry) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	var b strings.Builder
+	base := (&url.URL{Path: urlPath}).EscapedPath()
+	title := html.EscapeString("Index of " + urlPath)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := base + url.PathEscape(entry.Name())
+		if entry.IsDir() {
+			href += "/"
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body></html>\n")
+	return []byte(b.String())
+}
+
+var contentTypes = map[string]string{
+	".html": TypeTextHTML,
+	".htm":  TypeTextHTML,
+	".css":  "text/css",
+	".js":   "text/javascript",
+	".json": TypeJSON,
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".svg":  "image/svg+xml",
+	".ico":  TypeIcon,
+	".txt":  TypeTextPlain,
+}
+
+// withCharset appends "; charset=utf-8" to text and JSON content types
+// that do not already declare a charset. Binary types are returned as
+// is.
+func withCharset(contentType string) string {
+	mt := mediaType(contentType)
+	if !strings.HasPrefix(mt, "text/") && mt != TypeJSON {
+		return contentType
+	}
+	if strings.Contains(strings.ToLower(contentType), "charset=") {
+		return contentType
+	}
+	return contentType + "; charset=utf-8"
+}
+
+func contentTypeForPath(name string) string {
+	if t, ok := contentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return t
+	}
+	return TypeOctetStream
+}
+
+// parseByteRange parses a single "bytes=" range against a body of the
+// given size and returns the inclusive start and end offsets. Syntax
+// errors and multi-range requests return errInvalidRange so callers
+// can ignore the header and serve the full body.
+func parseByteRange(header string, size int64) (start int64, end int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errInvalidRange
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errInvalidRange
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+	end = size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, errInvalidRange
+		}
+		if e < end {
+			end = e
+		}
+	}
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return start, end, nil
+}
+
+func handlePostFile(req request, res *response) {
+	p, ok := resolveFilePath(req, req.params["name"])
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	appending := isTrue(req.Query("append")) || isTrue(req.Header("X-Append"))
+	existed := false
+	if appending {
+		_, err := os.Stat(p)
+		existed = err == nil
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appending {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	defer invalidateCache(p)
+	if err := writeFile(p, flags, req.body); err != nil {
+		writeError(req, res, err)
+		return
+	}
+	if existed {
+		res.statusCode = ResponseOK
+		return
+	}
+	res.statusCode = ResponseCreated
+}
+
+func handlePutFile(req request, res *response) {
+	p, ok := resolveFilePath(req, req.params["name"])
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	if !ifMatch(req, p) {
+		res.statusCode = ResponsePreconditionFailed
+		return
+	}
+	_, err := os.Stat(p)
+	existed := err == nil
+	defer invalidateCache(p)
+	if err := writeFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, req.body); err != nil {
+		writeError(req, res, err)
+		return
+	}
+	if existed {
+		res.statusCode = ResponseOK
+		return
+	}
+	res.statusCode = ResponseCreated
+}
+
+// handlePatchFile writes the body into an existing file at the byte
+// offset given by X-Patch-Offset, overwriting what is there and
+// extending the file as needed. Without the header the body is
+// appended. An offset past the end of the file is answered with 416.
+func handlePatchFile(req request, res *response) {
+	p, ok := resolveFilePath(req, req.params["name"])
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	if !ifMatch(req, p) {
+		res.statusCode = ResponsePreconditionFailed
+		return
+	}
+	offset := info.Size()
+	if value := req.Header("X-Patch-Offset"); value != "" {
+		offset, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || offset < 0 {
+			responseError(req, res, ResponseBadRequest, fmt.Sprintf("invalid X-Patch-Offset %q", value))
+			return
+		}
+	}
+	if offset > info.Size() {
+		res.statusCode = ResponseRangeNotSatisfiable
+		res.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+		return
+	}
+	file, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		res.statusCode = writeErrorStatus(err)
+		return
+	}
+	defer file.Close()
+	defer invalidateCache(p)
+	if _, err := file.WriteAt([]byte(req.body), offset); err != nil {
+		res.statusCode = ResponseInternalError
+		return
+	}
+	res.statusCode = ResponseOK
+}
+
+// fileErrorStatus maps an error opening a file for reading to 404 when
+// it does not exist, 403 when it may not be read and 500 otherwise.
+func fileErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ResponseNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ResponseForbidden
+	}
+	return ResponseInternalError
+}
+
+// writeErrorStatus maps an error writing a file to 403 when it may not
+// be written and 500 otherwise.
+func writeErrorStatus(err error) int {
+	if errors.Is(err, fs.ErrPermission) {
+		return ResponseForbidden
+	}
+	return ResponseInternalError
+}
+
+// writeError answers a failed write with the status from
+// writeErrorStatus and the underlying reason, leaving out the
+// filesystem path.
+func writeError(req request, res *response, err error) {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	responseError(req, res, writeErrorStatus(err), "could not write file: "+err.Error())
+}
+
+// writeFile writes body to p opened with flags, first creating any
+// missing parent directories so that nested names such as
+// "a/b/c.txt" can be uploaded.
+func writeFile(p string, flags int, body string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(p, flags, 0o666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, strings.NewReader(body))
+	return err
+}
+
+func isTrue(value string) bool {
+	b, err := strconv.ParseBool(value)
+	return err == nil && b
+}
+
+// resolveFilePath joins name onto the directory served for the host of
+// req and reports false if no directory is served or the cleaned
+// result would escape it.
+func resolveFilePath(req request, name string) (string, bool) {
+	return resolvePath(rootFor(req), name)
+}
+
+// resolvePath joins name onto dir, reporting false if dir is empty or
+// the cleaned result would escape it.
+func resolvePath(dir string, name string) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	p := filepath.Join(root, filepath.FromSlash(name))
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return p, true
+}
+
+func handleDeleteFile(req request, res *response) {
+	p, ok := resolveFilePath(req, req.params["name"])
+	if !ok {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		res.statusCode = ResponseNotFound
+		return
+	}
+	if !ifMatch(req, p) {
+		res.statusCode = ResponsePreconditionFailed
+		return
+	}
+	defer invalidateCache(p)
+	err = os.Remove(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			res.statusCode = ResponseNotFound
+			return
+		}
+		res.statusCode = ResponseInternalError
+		return
+	}
+	res.statusCode = ResponseOK
+}
+
+func responseContent(res *response, content []byte, contentType string) {
+	if res.headers == nil {
 		res.headers = make(headers, 2)
 	}
-	res.status = ResponseOK
-	res.headers["Content-Type"] = contentType
-	res.headers["Content-Length"] = fmt.Sprint(len(content))
+	res.statusCode = ResponseOK
+	res.headers.Set("Content-Type", withCharset(contentType))
+	res.headers.Set("Content-Length", fmt.Sprint(len(content)))
 	res.content = content
 }
+
+// JSON marshals v as the response body with the given status. A value
+// that cannot be marshalled results in a 500 without a body.
+func (res *response) JSON(status int, v any) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Error marshalling JSON response: ", err.Error())
+		res.statusCode = ResponseInternalError
+		return
+	}
+	responseContent(res, content, TypeJSON)
+	res.statusCode = status
+}
+
+// responseError fills res with status and an error message, as plain
+// text or as a {"error": message} object for clients preferring JSON.
+func responseError(req request, res *response, status int, message string) {
+	if negotiateType(req, []string{TypeTextPlain, TypeJSON}) == TypeJSON {
+		res.JSON(status, map[string]string{"error": message})
+		return
+	}
+	responseContent(res, []byte(message), TypeTextPlain)
+	res.statusCode = status
+}
+
+// responseStream sets up res to copy size bytes from body when it is
+// written. A negative size means the length is unknown and the body is
+// sent with chunked transfer coding. Body is closed once the response
+// has been written.
+func responseStream(res *response, body io.ReadCloser, size int64, contentType string) {
+	res.statusCode = ResponseOK
+	res.SetHeader("Content-Type", withCharset(contentType))
+	if size < 0 {
+		res.SetHeader("Transfer-Encoding", "chunked")
+	} else {
+		res.SetHeader("Content-Length", fmt.Sprint(size))
+	}
+	res.bodyReader = body
+}
+
+// gzipStream returns a reader yielding the gzip compressed contents of
+// src. Closing it stops the compression and closes src.
+func gzipStream(src io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, src)
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// openPrecompressed opens the gzip-compressed sibling p+".gz" if it
+// exists as a regular file at least as new as original, the info of
+// p, returning it with its own info. An older sibling is stale and
+// ignored.
+func openPrecompressed(p string, original fs.FileInfo) (*os.File, fs.FileInfo, bool) {
+	gz, err := os.Open(p + ".gz")
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := gz.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(original.ModTime()) {
+		gz.Close()
+		return nil, nil, false
+	}
+	return gz, info, true
+}
+
+// negotiateType picks the media type from offered that the Accept
+// header of req rates highest, honoring "type/*" and "*/*" ranges and
+// q-values. Ties go to the earlier offer. Without an Accept header, or
+// when nothing offered is acceptable, the first offer is returned.
+func negotiateType(req request, offered []string) string {
+	if len(offered) == 0 {
+		return ""
+	}
+	accept := req.Header("Accept")
+	if accept == "" {
+		return offered[0]
+	}
+	best, bestQ := offered[0], 0.0
+	for _, offer := range offered {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value the Accept header assigns to
+// mediaType, using the most specific matching range.
+func acceptQuality(accept string, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch {
+		case rng == mediaType:
+			s = 2
+		case strings.HasSuffix(rng, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rng, "*")):
+			s = 1
+		case rng == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, qValue(params[1:])
+	}
+	return q
+}
+
+// qValue returns the q parameter among params of an Accept-style
+// header entry, or 1 when it is absent or invalid.
+func qValue(params []string) float64 {
+	for _, p := range params {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			}
+		}
+	}
+	return 1
+}
+
+// negotiateEncoding returns gzip when the Accept-Encoding header of
+// req gives it a non-zero q-value, by name or else through "*", and ""
+// for the identity encoding otherwise.
+func negotiateEncoding(req request) string {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, entry := range strings.Split(req.Header("Accept-Encoding"), ",") {
+		params := strings.Split(entry, ";")
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case EncodingGzip:
+			gzipQ = qValue(params[1:])
+		case "*":
+			anyQ = qValue(params[1:])
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if gzipQ > 0 {
+		return EncodingGzip
+	}
+	return ""
+}
+
+// encodeContent compresses the content of res with encoding, if that
+// is gzip. The response depends on Accept-Encoding either way, which
+// Vary tells caches.
+func encodeContent(res *response, encoding string) {
+	res.SetHeader("Vary", "Accept-Encoding")
+	if encoding != EncodingGzip {
+		return
+	}
+	content, err := gzipContent(res.content)
+	if err != nil {
+		fmt.Println("Error compressing response: ", err.Error())
+		return
+	}
+	res.headers.Set("Content-Encoding", encoding)
+	res.headers.Set("Content-Length", fmt.Sprint(len(content)))
+	res.content = content
+}
+
+// gzipContent returns content compressed with gzip.
+func gzipContent(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
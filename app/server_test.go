@@ -0,0 +1,1303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Flags are never parsed here, so the defaults that matter are set
+	// by hand.
+	quiet, logFormat, logSample = true, "text", 1
+	router = setupRouter()
+	os.Exit(m.Run())
+}
+
+// testResponse is a response as a client read it off the wire.
+type testResponse struct {
+	status  int
+	headers headers
+	body    string
+}
+
+// roundTrip writes raw to a connection served by handleConnection and
+// returns every response read until the server closes it.
+func roundTrip(t *testing.T, raw string) []testResponse {
+	t.Helper()
+	return exchange(t, raw, false)
+}
+
+// roundTripHead is roundTrip for HEAD requests, whose responses carry
+// Content-Length but no body.
+func roundTripHead(t *testing.T, raw string) []testResponse {
+	t.Helper()
+	return exchange(t, raw, true)
+}
+
+// roundTripClosed is roundTrip over loopback TCP with the client's
+// write side shut after raw, so the server sees the end of the stream
+// where raw ends, as it would from a client hanging up mid-request.
+func roundTripClosed(t *testing.T, raw string) []testResponse {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponses(t, client, server, func() {
+		io.WriteString(client, raw)
+		client.(*net.TCPConn).CloseWrite()
+	}, false)
+}
+
+func exchange(t *testing.T, raw string, head bool) []testResponse {
+	t.Helper()
+	client, server := net.Pipe()
+	return readResponses(t, client, server, func() { io.WriteString(client, raw) }, head)
+}
+
+// serve runs handleConnection on server and returns a function that
+// blocks until it has returned, so a test can restore the globals it
+// changed without racing the connection.
+func serve(server net.Conn) func() {
+	tracker.add(server)
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server)
+		close(done)
+	}()
+	return func() { <-done }
+}
+
+// readResponses serves server while send writes to client, and reads
+// responses off client until the server closes the connection.
+func readResponses(t *testing.T, client, server net.Conn, send func(), head bool) []testResponse {
+	t.Helper()
+	wait := serve(server)
+	defer wait()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go send()
+	reader := bufio.NewReader(client)
+	var responses []testResponse
+	for {
+		res, err := readTestResponse(reader, head)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("reading response %d: %v", len(responses)+1, err)
+			}
+			return responses
+		}
+		responses = append(responses, res)
+	}
+}
+
+// readTestResponse reads one response, decoding a chunked body and
+// otherwise taking the body to its Content-Length or, without one, to
+// the end of the stream. The
+// response to a HEAD request has no body to read.
+func readTestResponse(reader *bufio.Reader, head bool) (testResponse, error) {
+	res := testResponse{headers: headers{}}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		if line == "" {
+			return res, io.EOF
+		}
+		return res, err
+	}
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(fields) < 2 {
+		return res, io.ErrUnexpectedEOF
+	}
+	if res.status, err = strconv.Atoi(fields[1]); err != nil {
+		return res, err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return res, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		res.headers.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value))
+	}
+	if head {
+		return res, nil
+	}
+	var body []byte
+	if res.headers.Get("Transfer-Encoding") == "chunked" {
+		body, err = readChunkedBody(reader)
+	} else if cl := res.headers.Get("Content-Length"); cl != "" {
+		n, _ := strconv.Atoi(cl)
+		body = make([]byte, n)
+		_, err = io.ReadFull(reader, body)
+	} else if res.status >= 200 && res.status != ResponseNoContent && res.status != ResponseNotModified {
+		body, err = io.ReadAll(reader)
+	}
+	res.body = string(body)
+	return res, err
+}
+
+// parseRequest runs connectionToRequest over raw.
+func parseRequest(raw string) (request, error) {
+	return connectionToRequest(bufio.NewReader(strings.NewReader(raw)), io.Discard)
+}
+
+// withDirectory serves a fresh temporary -directory for the test.
+func withDirectory(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	prev := directory
+	directory = dir
+	t.Cleanup(func() { directory = prev })
+	return dir
+}
+
+func TestWriteToConnExactBytes(t *testing.T) {
+	res := response{statusCode: ResponseOK, content: []byte("abc")}
+	res.SetHeader("Content-Length", "3")
+	var buf bytes.Buffer
+	if _, err := res.WriteToConn(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nabc")) {
+		t.Errorf("response ends in %q, want the raw body after the blank line", buf.Bytes()[buf.Len()-7:])
+	}
+}
+
+func TestFilesTraversalRefused(t *testing.T) {
+	dir := withDirectory(t)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/files/../server.go", "/files/../secret", "/files/%2e%2e/secret"} {
+		res := roundTrip(t, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 || res[0].status != ResponseNotFound {
+			t.Errorf("GET %s: got %+v, want a single 404", path, res)
+		}
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	dir := withDirectory(t)
+	if err := os.WriteFile(filepath.Join(dir, "x.txt"), []byte("hello head\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/echo/hello", "/files/x.txt", "/nope"} {
+		gets := roundTrip(t, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		heads := roundTripHead(t, "HEAD "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if len(gets) != 1 || len(heads) != 1 {
+			t.Fatalf("%s: got %d GET and %d HEAD responses, want 1 each", path, len(gets), len(heads))
+		}
+		get, head := gets[0], heads[0]
+		if head.body != "" {
+			t.Errorf("HEAD %s: body %q, want none", path, head.body)
+		}
+		if get.status != head.status {
+			t.Errorf("%s: HEAD status %d, GET status %d", path, head.status, get.status)
+		}
+		for _, name := range []string{"Content-Length", "Content-Type", "Etag", "Last-Modified"} {
+			if get.headers.Get(name) != head.headers.Get(name) {
+				t.Errorf("%s: HEAD %s %q, GET %q", path, name, head.headers.Get(name), get.headers.Get(name))
+			}
+		}
+	}
+}
+
+func TestParseErrorsAnswered(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"garbage", "GARBAGE\r\n\r\n", ResponseBadRequest},
+		{"te and cl", "POST /files/x HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ResponseBadRequest},
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", ResponseBadRequest},
+		{"space before colon", "POST /echo/x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding : chunked\r\nContent-Length: 3\r\n\r\nabc", ResponseBadRequest},
+		{"bad version", "GET / HTTP/2.0\r\nHost: x\r\n\r\n", ResponseVersionNotSupported},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, tt.raw)
+		if len(res) != 1 {
+			t.Errorf("%s: got %d responses, want 1", tt.name, len(res))
+			continue
+		}
+		if res[0].status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, res[0].status, tt.status)
+		}
+		if res[0].headers.Get("Connection") != "close" {
+			t.Errorf("%s: Connection %q, want close", tt.name, res[0].headers.Get("Connection"))
+		}
+	}
+}
+
+func TestPipelinedResponsesInOrder(t *testing.T) {
+	res := roundTrip(t, "GET /echo/one HTTP/1.1\r\nHost: x\r\n\r\nGET /echo/two HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 2 {
+		t.Fatalf("got %d responses, want 2", len(res))
+	}
+	if res[0].body != "one" || res[1].body != "two" {
+		t.Errorf("bodies %q, %q, want one, two", res[0].body, res[1].body)
+	}
+}
+
+func TestPanicAnswered500(t *testing.T) {
+	prev := router
+	router = NewRouter()
+	router.Handle("GET", "/panic", func(req request, res *response) {
+		var m map[string]int
+		m["x"]++
+	})
+	defer func() { router = prev }()
+	res := roundTrip(t, "GET /panic HTTP/1.1\r\nHost: x\r\n\r\nGET /panic HTTP/1.1\r\nHost: x\r\n\r\n")
+	if len(res) != 1 {
+		t.Fatalf("got %d responses, want 1 before the connection closes", len(res))
+	}
+	if res[0].status != ResponseInternalError {
+		t.Errorf("status %d, want %d", res[0].status, ResponseInternalError)
+	}
+}
+
+func TestConnectionPanicRecovered(t *testing.T) {
+	prev := router
+	router = NewRouter()
+	router.Handle("GET", "/up", func(req request, res *response) {
+		res.statusCode = ResponseSwitchingProtocols
+		res.upgrade = func(r *bufio.Reader, w io.Writer) {
+			panic("upgraded protocol failed")
+		}
+	})
+	defer func() { router = prev }()
+	res := roundTrip(t, "GET /up HTTP/1.1\r\nHost: x\r\n\r\n")
+	if len(res) != 1 || res[0].status != ResponseSwitchingProtocols {
+		t.Errorf("got %+v, want the 101 before the connection closes", res)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", `attachment; filename="a.txt"`},
+		{`a"b\c.txt`, `attachment; filename="a_b_c.txt"`},
+		{"evil\r\nSet-Cookie: pwned=1", `attachment; filename="evilSet-Cookie: pwned=1"`},
+		{"résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadQuery(t *testing.T) {
+	dir := withDirectory(t)
+	for _, name := range []string{"x.txt", "evil\r\nSet-Cookie: pwned=1"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/files/x.txt", ""},
+		{"/files/x.txt?download=0", ""},
+		{"/files/x.txt?download=1", `attachment; filename="x.txt"`},
+		{"/files/evil%0d%0aSet-Cookie:%20pwned=1?download=1", `attachment; filename="evilSet-Cookie: pwned=1"`},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, "GET "+tt.target+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 {
+			t.Fatalf("%s: got %d responses, want 1", tt.target, len(res))
+		}
+		if got := res[0].headers.Get("Content-Disposition"); got != tt.want {
+			t.Errorf("%s: Content-Disposition %q, want %q", tt.target, got, tt.want)
+		}
+		if cookie := res[0].headers.Get("Set-Cookie"); cookie != "" {
+			t.Errorf("%s: injected Set-Cookie %q", tt.target, cookie)
+		}
+	}
+}
+
+func TestTransferEncoding(t *testing.T) {
+	tests := []struct {
+		te     string
+		body   string
+		status int
+	}{
+		{"chunked", "3;ext=1\r\nabc\r\n2\r\nde\r\n0\r\nTrailer: x\r\n\r\n", 0},
+		{"Chunked", "0\r\n\r\n", 0},
+		{"identity", "abc", ResponseBadRequest},
+		{"xchunked", "0\r\n\r\n", ResponseBadRequest},
+		{"chunked, chunked", "0\r\n\r\n", ResponseBadRequest},
+		{"chunked, gzip", "0\r\n\r\n", ResponseBadRequest},
+		{"gzip, chunked", "0\r\n\r\n", ResponseNotImplemented},
+	}
+	for _, tt := range tests {
+		req, err := parseRequest("POST /x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: " + tt.te + "\r\n\r\n" + tt.body)
+		status, _ := parseErrorStatus(err)
+		if status != tt.status {
+			t.Errorf("Transfer-Encoding %q: status %d (%v), want %d", tt.te, status, err, tt.status)
+		}
+		if tt.status == 0 && tt.te == "chunked" && req.body != "abcde" {
+			t.Errorf("chunked body %q, want abcde", req.body)
+		}
+	}
+}
+
+func TestUnknownTransferEncodingNotSmuggled(t *testing.T) {
+	smuggled := "GET /echo/smuggled HTTP/1.1\r\nHost: x\r\n\r\n"
+	res := roundTrip(t, "POST /echo/x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: identity\r\n\r\n"+smuggled)
+	if len(res) != 1 || res[0].status != ResponseBadRequest {
+		t.Fatalf("got %+v, want a single 400", res)
+	}
+}
+
+func TestParseHeaderLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   string
+		want    map[string]string
+		invalid bool
+	}{
+		{"no space after colon", "Host:example.com\r\n", map[string]string{"Host": "example.com"}, false},
+		{"colons in value", "X-Url: http://a:8080/x\r\n", map[string]string{"X-Url": "http://a:8080/x"}, false},
+		{"surrounding whitespace", "X-A: \t v \t\r\n", map[string]string{"X-A": "v"}, false},
+		{"folded", "X-A: one\r\n  two\r\n\tthree\r\n", map[string]string{"X-A": "one two three"}, false},
+		{"whitespace-only continuation", "X-A: one\r\n \r\n", map[string]string{"X-A": "one"}, false},
+		{"empty lines", "\r\nX-A: v\r\n\r\n", map[string]string{"X-A": "v"}, false},
+		{"space before colon", "Transfer-Encoding : chunked\r\n", nil, true},
+		{"space in name", "X A: v\r\n", nil, true},
+		{"no colon", "X-A\r\n", nil, true},
+		{"empty name", ": v\r\n", nil, true},
+	}
+	for _, tt := range tests {
+		var req request
+		err := parseHeaderLines([]byte(tt.lines), &req)
+		if tt.invalid {
+			if !errors.Is(err, errMalformedRequest) {
+				t.Errorf("%s: err %v, want errMalformedRequest", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(req.headers) != len(tt.want) {
+			t.Errorf("%s: headers %v, want %v", tt.name, req.headers, tt.want)
+		}
+		for k, v := range tt.want {
+			if got := req.Header(k); got != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got, v)
+			}
+		}
+	}
+}
+
+func TestStrictHeadersRejectFolding(t *testing.T) {
+	strictHeaders = true
+	defer func() { strictHeaders = false }()
+	var req request
+	if err := parseHeaderLines([]byte("X-A: one\r\n two\r\n"), &req); !errors.Is(err, errMalformedRequest) {
+		t.Errorf("err %v, want errMalformedRequest", err)
+	}
+}
+
+func TestHeadNeverUpgrades(t *testing.T) {
+	upgrade := "Host: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	res := roundTripHead(t, "HEAD /ws HTTP/1.1\r\n"+upgrade+"HEAD /echo/x HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 2 {
+		t.Fatalf("got %d responses, want 2 on a connection that stays HTTP", len(res))
+	}
+	if res[0].status != ResponseUpgradeRequired || res[0].headers.Get("Upgrade") != "websocket" {
+		t.Errorf("HEAD /ws: status %d Upgrade %q, want 426 websocket", res[0].status, res[0].headers.Get("Upgrade"))
+	}
+	if res[1].status != ResponseOK {
+		t.Errorf("follow-up status %d, want 200", res[1].status)
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// The sample handshake of RFC 6455 section 1.3.
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %q", got)
+	}
+}
+
+func TestAdminShutdownNeedsCredentials(t *testing.T) {
+	enableAdmin = true
+	defer func() { enableAdmin, authUser, authPass = false, "", "" }()
+	tests := []struct {
+		user, pass string
+		status     int
+	}{
+		{"", "", ResponseNotFound},
+		{"admin", "", ResponseNotFound},
+		{"", "secret", ResponseNotFound},
+		{"admin", "secret", ResponseUnauthorized},
+	}
+	for _, tt := range tests {
+		authUser, authPass = tt.user, tt.pass
+		var res response
+		setupRouter().ServeRequest(request{method: "POST", path: "/admin/shutdown"}, &res)
+		if res.statusCode != tt.status {
+			t.Errorf("credentials %q/%q: status %d, want %d", tt.user, tt.pass, res.statusCode, tt.status)
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, s)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPrecompressedSibling(t *testing.T) {
+	dir := withDirectory(t)
+	p := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(p, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p+".gz", gzipBytes(t, "precompressed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	original := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name     string
+		gzTime   time.Time
+		accept   string
+		encoding string
+	}{
+		{"fresh sibling", original.Add(time.Minute), "gzip", "gzip"},
+		{"not accepted", original.Add(time.Minute), "", ""},
+		{"stale sibling", original.Add(-time.Minute), "gzip", "gzip"},
+	}
+	for _, tt := range tests {
+		os.Chtimes(p, original, original)
+		os.Chtimes(p+".gz", tt.gzTime, tt.gzTime)
+		raw := "GET /files/a.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"
+		if tt.accept != "" {
+			raw += "Accept-Encoding: " + tt.accept + "\r\n"
+		}
+		res := roundTrip(t, raw+"\r\n")
+		if len(res) != 1 {
+			t.Fatalf("%s: got %d responses, want 1", tt.name, len(res))
+		}
+		r := res[0]
+		if r.headers.Get("Content-Encoding") != tt.encoding {
+			t.Fatalf("%s: Content-Encoding %q, want %q", tt.name, r.headers.Get("Content-Encoding"), tt.encoding)
+		}
+		if r.headers.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q, want Accept-Encoding", tt.name, r.headers.Get("Vary"))
+		}
+		body := r.body
+		if tt.encoding == "gzip" {
+			zr, err := gzip.NewReader(strings.NewReader(r.body))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			plain, _ := io.ReadAll(zr)
+			body = string(plain)
+			if !strings.HasSuffix(r.headers.Get("Etag"), `-gzip"`) {
+				t.Errorf("%s: ETag %q, want a gzip entity tag", tt.name, r.headers.Get("Etag"))
+			}
+		}
+		want := "hello\n"
+		if tt.name == "fresh sibling" {
+			want = "precompressed\n"
+		}
+		if body != want {
+			t.Errorf("%s: body %q, want %q", tt.name, body, want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"encoding-1, gzip, encoding-3", "gzip"},
+		{"GZIP;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip; q=0.0, identity", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", ""},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		req := request{headers: headers{"Accept-Encoding": {tt.accept}}}
+		if got := negotiateEncoding(req); got != tt.want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestEchoVaryAcceptEncoding(t *testing.T) {
+	for _, accept := range []string{"gzip", "identity"} {
+		res := roundTrip(t, "GET /echo/abc HTTP/1.1\r\nHost: x\r\nAccept-Encoding: "+accept+"\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 || res[0].headers.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %s: got %+v, want Vary: Accept-Encoding", accept, res)
+		}
+	}
+}
+
+// withCache serves files through a fresh cache of budget bytes.
+func withCache(t testing.TB, budget int64) {
+	prev := cache
+	cache = newFileCache(budget)
+	t.Cleanup(func() { cache = prev })
+}
+
+func TestFileCache(t *testing.T) {
+	dir := withDirectory(t)
+	withCache(t, 1<<20)
+	p := filepath.Join(dir, "c.txt")
+	if err := os.WriteFile(p, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	get := func(accept string) string {
+		t.Helper()
+		res := roundTrip(t, "GET /files/c.txt HTTP/1.1\r\nHost: x\r\nAccept-Encoding: "+accept+"\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 {
+			t.Fatalf("got %d responses, want 1", len(res))
+		}
+		if res[0].headers.Get("Content-Encoding") != EncodingGzip {
+			return res[0].body
+		}
+		zr, err := gzip.NewReader(strings.NewReader(res[0].body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, _ := io.ReadAll(zr)
+		return string(plain)
+	}
+	for _, accept := range []string{"identity", "gzip"} {
+		get(accept)
+	}
+	// Same size and modification time leave the ETag unchanged, so the
+	// cached representations are still served.
+	info, _ := os.Stat(p)
+	os.WriteFile(p, []byte("other"), 0644)
+	os.Chtimes(p, info.ModTime(), info.ModTime())
+	for _, accept := range []string{"identity", "gzip"} {
+		if got := get(accept); got != "first" {
+			t.Errorf("Accept-Encoding %s: got %q, want the cached first", accept, got)
+		}
+	}
+	res := roundTrip(t, "PUT /files/c.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\nConnection: close\r\n\r\nsecond")
+	if len(res) != 1 || res[0].status >= 300 {
+		t.Fatalf("PUT: got %+v", res)
+	}
+	os.Chtimes(p, info.ModTime(), info.ModTime())
+	for _, accept := range []string{"identity", "gzip"} {
+		if got := get(accept); got != "second" {
+			t.Errorf("Accept-Encoding %s after PUT: got %q, want second", accept, got)
+		}
+	}
+}
+
+func benchmarkServeFile(b *testing.B, cached bool, accept string) {
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "b.html"), bytes.Repeat([]byte("<p>cached</p>\n"), 1000), 0644); err != nil {
+		b.Fatal(err)
+	}
+	if cached {
+		withCache(b, 1<<20)
+	}
+	req := request{method: "GET", path: "/files/b.html", version: "HTTP/1.1", headers: headers{"Accept-Encoding": {accept}}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var res response
+		serveFile(req, &res, dir, "b.html")
+		if _, err := res.WriteToConn(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServeFileUncached(b *testing.B)     { benchmarkServeFile(b, false, "identity") }
+func BenchmarkServeFileCached(b *testing.B)       { benchmarkServeFile(b, true, "identity") }
+func BenchmarkServeFileGzipUncached(b *testing.B) { benchmarkServeFile(b, false, "gzip") }
+func BenchmarkServeFileGzipCached(b *testing.B)   { benchmarkServeFile(b, true, "gzip") }
+
+func TestLoggedBytesCountStreamedBodies(t *testing.T) {
+	dir := withDirectory(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), bytes.Repeat([]byte("log me "), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var text, events, access bytes.Buffer
+	prevLogger, prevEvents := logger, eventLogger
+	logger, eventLogger = log.New(&text, "", 0), log.New(&events, "", 0)
+	accessLog = &accessLogger{w: &access}
+	quiet = false
+	defer func() {
+		logger, eventLogger, accessLog, quiet, logFormat = prevLogger, prevEvents, nil, true, "text"
+	}()
+	raw := "GET /files/a.txt HTTP/1.1\r\nHost: x\r\nAccept-Encoding: gzip\r\nConnection: close\r\n\r\n"
+	res := roundTrip(t, raw)
+	if len(res) != 1 || res[0].headers.Get("Transfer-Encoding") != "chunked" {
+		t.Fatalf("got %+v, want a chunked gzip response", res)
+	}
+	n := strconv.Itoa(len(res[0].body))
+	if !strings.Contains(text.String(), " "+n+"b ") {
+		t.Errorf("text log %q does not report %s body bytes", text.String(), n)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(access.String()), " 200 "+n) {
+		t.Errorf("access log %q does not report %s body bytes", access.String(), n)
+	}
+	logFormat = "json"
+	roundTrip(t, raw)
+	var event logEvent
+	if err := json.Unmarshal(events.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if strconv.FormatInt(event.Bytes, 10) != n {
+		t.Errorf("JSON log bytes %d, want %s", event.Bytes, n)
+	}
+}
+
+func TestContentTypeCharset(t *testing.T) {
+	dir := withDirectory(t)
+	for _, name := range []string{"a.txt", "a.html", "a.json", "a.bin"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/echo/héllo", "text/plain; charset=utf-8"},
+		{"/metrics", "text/plain; version=0.0.4"},
+		{"/files/a.txt", "text/plain; charset=utf-8"},
+		{"/files/a.html", "text/html; charset=utf-8"},
+		{"/files/a.json", "application/json; charset=utf-8"},
+		{"/files/a.bin", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 {
+			t.Fatalf("%s: got %d responses, want 1", tt.path, len(res))
+		}
+		if got := res[0].headers.Get("Content-Type"); got != tt.want {
+			t.Errorf("%s: Content-Type %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTraceOmitsFoldedCredentials(t *testing.T) {
+	req, err := parseRequest("TRACE / HTTP/1.1\r\nHost: x\r\nAuthorization: Basic\r\n c2VjcmV0\r\nCookie: a=1\r\n\tb=2\r\nX-Kept: one\r\n two\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res response
+	handleTrace(req, &res)
+	body := string(res.content)
+	for _, leaked := range []string{"Authorization", "c2VjcmV0", "Cookie", "b=2"} {
+		if strings.Contains(body, leaked) {
+			t.Errorf("TRACE body leaks %q:\n%s", leaked, body)
+		}
+	}
+	if !strings.Contains(body, "X-Kept: one\r\n two\r\n") {
+		t.Errorf("TRACE body lost a folded field that is not excluded:\n%s", body)
+	}
+}
+
+func TestParseErrorsRecorded(t *testing.T) {
+	var access bytes.Buffer
+	accessLog = &accessLogger{w: &access}
+	defer func() { accessLog = nil }()
+	before := metrics.statusClasses[3].Load()
+	res := roundTrip(t, "GET / HTTP/1.1\r\nBad Header: x\r\n\r\n")
+	if len(res) != 1 || res[0].status != ResponseBadRequest {
+		t.Fatalf("got %+v, want one 400", res)
+	}
+	if got := metrics.statusClasses[3].Load(); got != before+1 {
+		t.Errorf("4xx count %d, want %d", got, before+1)
+	}
+	if !strings.Contains(access.String(), `"GET / HTTP/1.1" 400 `) {
+		t.Errorf("access log %q does not record the rejected request", access.String())
+	}
+}
+
+func TestConnectionTokenList(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   string
+		count int
+	}{
+		{"close among options", "GET /echo/a HTTP/1.1\r\nHost: x\r\nConnection: close, TE\r\n\r\nGET /echo/b HTTP/1.1\r\nHost: x\r\n\r\n", 1},
+		{"close in a second field", "GET /echo/a HTTP/1.1\r\nHost: x\r\nConnection: TE\r\nConnection: Close\r\n\r\nGET /echo/b HTTP/1.1\r\nHost: x\r\n\r\n", 1},
+		{"HTTP/1.0 keep-alive among options", "GET /echo/a HTTP/1.0\r\nConnection: keep-alive, Upgrade\r\n\r\nGET /echo/b HTTP/1.0\r\n\r\n", 2},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, tt.raw)
+		if len(res) != tt.count {
+			t.Errorf("%s: got %d responses, want %d", tt.name, len(res), tt.count)
+			continue
+		}
+		want := "keep-alive"
+		if tt.count == 1 {
+			want = "close"
+		}
+		if got := res[0].headers.Get("Connection"); got != want {
+			t.Errorf("%s: Connection %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	dir := withDirectory(t)
+	maxBodySize = 4
+	defer func() { maxBodySize = 0 }()
+	for _, method := range []string{"POST", "PUT", "PATCH"} {
+		res := roundTrip(t, method+" /files/big HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello")
+		if len(res) != 1 || res[0].status != ResponsePayloadTooLarge {
+			t.Errorf("%s Content-Length: got %+v, want one 413", method, res)
+		}
+		res = roundTrip(t, method+" /files/big HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n")
+		if len(res) != 1 || res[0].status != ResponsePayloadTooLarge {
+			t.Errorf("%s chunked: got %+v, want one 413", method, res)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big")); !os.IsNotExist(err) {
+		t.Errorf("oversized body was written: %v", err)
+	}
+}
+
+func TestPipelinedBodiesDoNotBleed(t *testing.T) {
+	withDirectory(t)
+	long := strings.Repeat("L", 5000)
+	raw := "POST /files/a HTTP/1.1\r\nHost: x\r\nContent-Length: 5000\r\n\r\n" + long +
+		"POST /files/b HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n1\r\nd\r\n0\r\n\r\n" +
+		"POST /files/c HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n" +
+		"POST /files/d HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhi" +
+		"GET /files/a HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"GET /files/b HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"GET /files/c HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"GET /files/d HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"
+	res := roundTrip(t, raw)
+	if len(res) != 8 {
+		t.Fatalf("got %d responses, want 8", len(res))
+	}
+	for i, r := range res[:4] {
+		if r.status != ResponseCreated {
+			t.Errorf("POST %d: status %d, want 201", i, r.status)
+		}
+	}
+	for i, want := range []string{long, "abcd", "", "hi"} {
+		if r := res[4+i]; r.status != ResponseOK || r.body != want {
+			t.Errorf("GET %d: status %d body %.20q (%d bytes), want 200 with %d bytes", i, r.status, r.body, len(r.body), len(want))
+		}
+	}
+}
+
+func TestHeadersLargerThanInitialBuffer(t *testing.T) {
+	maxHeaderBytes = 32 << 10
+	defer func() { maxHeaderBytes = 0 }()
+	big := strings.Repeat("b", 20<<10)
+	res := roundTrip(t, "GET /user-agent HTTP/1.1\r\nHost: x\r\nX-Big: "+big+"\r\nUser-Agent: after-the-big-one\r\n\r\n"+
+		"GET /echo/"+strings.Repeat("p", 10<<10)+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 2 {
+		t.Fatalf("got %d responses, want 2", len(res))
+	}
+	if res[0].status != ResponseOK || res[0].body != "after-the-big-one" {
+		t.Errorf("status %d body %q, want the User-Agent after a 20KB header", res[0].status, res[0].body)
+	}
+	if res[1].status != ResponseOK || len(res[1].body) != 10<<10 {
+		t.Errorf("status %d with %d body bytes, want a 10KB echo", res[1].status, len(res[1].body))
+	}
+	res = roundTrip(t, "GET /user-agent HTTP/1.1\r\nHost: x\r\nX-Big: "+strings.Repeat("b", 32<<10)+"\r\n\r\n")
+	if len(res) != 1 || res[0].status != ResponseHeaderFieldsTooLarge {
+		t.Errorf("got %+v, want one 431 once headers pass -max-header-bytes", res)
+	}
+}
+
+func TestHugeContentLengthNotAllocated(t *testing.T) {
+	// With no -max-body-size the claimed length must not be allocated
+	// up front; the body simply ends early.
+	_, err := parseRequest("POST /files/x HTTP/1.1\r\nHost: x\r\nContent-Length: 9223372036854775807\r\n\r\nabc")
+	if !errors.Is(err, errMalformedRequest) {
+		t.Errorf("err %v, want errMalformedRequest", err)
+	}
+	res := roundTripClosed(t, "POST /files/x HTTP/1.1\r\nHost: x\r\nContent-Length: 100000000000\r\n\r\nabc")
+	if len(res) != 1 || res[0].status != ResponseBadRequest {
+		t.Errorf("got %+v, want one 400", res)
+	}
+}
+
+func TestChunkedFramingBounded(t *testing.T) {
+	maxHeaderBytes = 1 << 10
+	defer func() { maxHeaderBytes = 0 }()
+	tests := []struct {
+		name string
+		raw  string
+		want error
+	}{
+		{"largest chunk size", "7fffffffffffffff\r\nabc", errMalformedRequest},
+		{"chunk size overflowing int64", "8000000000000000\r\nabc", errMalformedRequest},
+		{"long chunk extension", "3;" + strings.Repeat("x", 8<<10) + "\r\nabc\r\n0\r\n\r\n", errMalformedRequest},
+		{"long trailer", "3\r\nabc\r\n0\r\nX-T: " + strings.Repeat("x", 2<<10) + "\r\n\r\n", errHeaderTooLarge},
+	}
+	for _, tt := range tests {
+		_, err := parseRequest("POST /files/x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" + tt.raw)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	req, err := parseRequest("POST /files/x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3;ext=1\r\nabc\r\n2\r\nde\r\n0\r\nX-T: y\r\n\r\n")
+	if err != nil || req.body != "abcde" {
+		t.Errorf("body %q err %v, want abcde", req.body, err)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	var interim bytes.Buffer
+	raw := "POST /files/x HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi"
+	if _, err := connectionToRequest(bufio.NewReader(strings.NewReader(raw)), &interim); err != nil {
+		t.Fatal(err)
+	}
+	if interim.Len() != 0 {
+		t.Errorf("HTTP/1.0 client was sent %q", interim.String())
+	}
+
+	// A keep-alive client idling past the last response's write
+	// deadline still gets its 100 Continue.
+	withDirectory(t)
+	prevWrite, prevIdle := writeTimeout, idleTimeout
+	writeTimeout, idleTimeout = 50*time.Millisecond, 2*time.Second
+	defer func() { writeTimeout, idleTimeout = prevWrite, prevIdle }()
+	client, server := net.Pipe()
+	wait := serve(server)
+	defer wait()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	go io.WriteString(client, "GET /echo/a HTTP/1.1\r\nHost: x\r\n\r\n")
+	if res, err := readTestResponse(reader, false); err != nil || res.status != ResponseOK {
+		t.Fatalf("first response %+v, %v", res, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	go io.WriteString(client, "POST /files/x HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n")
+	res, err := readTestResponse(reader, false)
+	if err != nil || res.status != ResponseContinue {
+		t.Fatalf("got %+v, %v, want 100 Continue", res, err)
+	}
+	go io.WriteString(client, "hi")
+	if res, err := readTestResponse(reader, false); err != nil || res.status != ResponseCreated {
+		t.Errorf("got %+v, %v, want 201", res, err)
+	}
+}
+
+func TestErrorBodies(t *testing.T) {
+	withDirectory(t)
+	tests := []struct {
+		name, raw, contentType, body string
+		status                       int
+	}{
+		{"router 404", "GET /nope HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", "text/plain; charset=utf-8", "not found", ResponseNotFound},
+		{"router 404 as JSON", "GET /nope HTTP/1.1\r\nHost: x\r\nAccept: application/json\r\nConnection: close\r\n\r\n", "application/json; charset=utf-8", `{"error":"not found"}`, ResponseNotFound},
+		{"router 405 as JSON", "POST /user-agent HTTP/1.1\r\nHost: x\r\nAccept: application/json\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", "application/json; charset=utf-8", `{"error":"method not allowed"}`, ResponseMethodNotAllowed},
+		{"file 404", "GET /files/missing HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", "text/plain; charset=utf-8", "not found", ResponseNotFound},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, tt.raw)
+		if len(res) != 1 {
+			t.Errorf("%s: got %d responses, want 1", tt.name, len(res))
+			continue
+		}
+		if res[0].status != tt.status || res[0].headers.Get("Content-Type") != tt.contentType || strings.TrimSpace(res[0].body) != tt.body {
+			t.Errorf("%s: got %d %q %q, want %d %q %q", tt.name, res[0].status, res[0].headers.Get("Content-Type"), res[0].body, tt.status, tt.contentType, tt.body)
+		}
+	}
+}
+
+func TestPercentEncodedPaths(t *testing.T) {
+	dir := withDirectory(t)
+	if err := os.WriteFile(filepath.Join(dir, "my file.txt"), []byte("spaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, target, body string
+		status             int
+	}{
+		{"space", "/files/my%20file.txt", "spaced", ResponseOK},
+		{"encoded slash in a param", "/echo/a%2Fb", "a/b", ResponseOK},
+		{"encoded space in a param", "/echo/hello%20world", "hello world", ResponseOK},
+		{"invalid escape", "/echo/%zz", "", ResponseBadRequest},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, "GET "+tt.target+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 {
+			t.Errorf("%s: got %d responses, want 1", tt.name, len(res))
+			continue
+		}
+		if res[0].status != tt.status || (tt.status == ResponseOK && res[0].body != tt.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, res[0].status, res[0].body, tt.status, tt.body)
+		}
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	dir := withDirectory(t)
+	res := roundTripClosed(t, "POST /files/short HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabc")
+	if len(res) != 1 || res[0].status != ResponseBadRequest || res[0].headers.Get("Connection") != "close" {
+		t.Errorf("short body: got %+v, want one 400 with Connection: close", res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "short")); !os.IsNotExist(err) {
+		t.Errorf("short body was written: %v", err)
+	}
+	res = roundTrip(t, "POST /files/long HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhiGET /echo/next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 2 {
+		t.Fatalf("extra bytes: got %d responses, want 2", len(res))
+	}
+	if res[0].status != ResponseCreated || res[1].status != ResponseOK || res[1].body != "next" {
+		t.Errorf("extra bytes: got %d then %d %q, want 201 then the next request's 200", res[0].status, res[1].status, res[1].body)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "long")); string(b) != "hi" {
+		t.Errorf("stored %q, want the body cut at Content-Length", b)
+	}
+}
+
+func TestIdleConnectionClosed(t *testing.T) {
+	prev := idleTimeout
+	idleTimeout = 50 * time.Millisecond
+	defer func() { idleTimeout = prev }()
+	client, server := net.Pipe()
+	wait := serve(server)
+	defer wait()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	go io.WriteString(client, "GET /echo/a HTTP/1.1\r\nHost: x\r\n\r\n")
+	if res, err := readTestResponse(reader, false); err != nil || res.headers.Get("Connection") != "keep-alive" {
+		t.Fatalf("got %+v, %v, want a kept-alive response", res, err)
+	}
+	start := time.Now()
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("read %v, want the server to close the idle connection", err)
+	}
+	if elapsed := time.Since(start); elapsed < idleTimeout {
+		t.Errorf("closed after %s, before -idle-timeout of %s", elapsed, idleTimeout)
+	}
+}
+
+func TestMaxPipeline(t *testing.T) {
+	prev := maxPipeline
+	maxPipeline = 3
+	defer func() { maxPipeline = prev }()
+	res := roundTrip(t, strings.Repeat("GET /echo/a HTTP/1.1\r\nHost: x\r\n\r\n", 5))
+	if len(res) != 3 {
+		t.Fatalf("got %d responses, want 3", len(res))
+	}
+	for i, r := range res {
+		want := "keep-alive"
+		if i == len(res)-1 {
+			want = "close"
+		}
+		if got := r.headers.Get("Connection"); got != want {
+			t.Errorf("response %d: Connection %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestUnreadableFileForbidden(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files whatever their mode")
+	}
+	dir := withDirectory(t)
+	p := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(p, []byte("x"), 0200); err != nil {
+		t.Fatal(err)
+	}
+	res := roundTrip(t, "GET /files/secret.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 1 || res[0].status != ResponseForbidden {
+		t.Errorf("got %+v, want one 403", res)
+	}
+	if got := fileErrorStatus(fs.ErrPermission); got != ResponseForbidden {
+		t.Errorf("fileErrorStatus(ErrPermission) = %d, want 403", got)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	dir := withDirectory(t)
+	if err := os.WriteFile(filepath.Join(dir, "r.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	get := "GET /files/r.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"
+	etag := roundTrip(t, get+"\r\n")[0].headers.Get("Etag")
+	tests := []struct {
+		name, ifRange, body string
+		status              int
+	}{
+		{"matching etag", etag, "012", ResponsePartialContent},
+		{"mismatched etag", `"stale"`, "0123456789", ResponseOK},
+		{"weak etag", "W/" + etag, "0123456789", ResponseOK},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, get+"Range: bytes=0-2\r\nIf-Range: "+tt.ifRange+"\r\n\r\n")
+		if len(res) != 1 || res[0].status != tt.status || res[0].body != tt.body {
+			t.Errorf("%s: got %+v, want %d %q", tt.name, res, tt.status, tt.body)
+		}
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	dir := withDirectory(t)
+	p := filepath.Join(dir, "m.txt")
+	if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	get := "GET /files/m.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"
+	lastModified := roundTrip(t, get+"\r\n")[0].headers.Get("Last-Modified")
+	if res := roundTrip(t, get+"If-Modified-Since: "+lastModified+"\r\n\r\n"); res[0].status != ResponseNotModified {
+		t.Errorf("unchanged file: status %d, want 304", res[0].status)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(p, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if res := roundTrip(t, get+"If-Modified-Since: "+lastModified+"\r\n\r\n"); res[0].status != ResponseOK || res[0].body != "x" {
+		t.Errorf("touched file: got %d %q, want 200 with the body", res[0].status, res[0].body)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	dir := withDirectory(t)
+	a, b := t.TempDir(), t.TempDir()
+	for d, content := range map[string]string{dir: "default", a: "site a", b: "site b"} {
+		if err := os.WriteFile(filepath.Join(d, "index.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vhosts.Set("a.example=" + a)
+	vhosts.Set("B.example=" + b)
+	defer func() { vhosts = vhostFlag{} }()
+	tests := []struct{ host, body string }{
+		{"a.example", "site a"},
+		{"a.example:4221", "site a"},
+		{"b.EXAMPLE", "site b"},
+		{"[::1]:4221", "default"},
+		{"other.example", "default"},
+	}
+	for _, tt := range tests {
+		res := roundTrip(t, "GET /files/index.txt HTTP/1.1\r\nHost: "+tt.host+"\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 || res[0].body != tt.body {
+			t.Errorf("Host %s: got %+v, want %q", tt.host, res, tt.body)
+		}
+	}
+}
+
+func TestUploadCreatesParentDirectories(t *testing.T) {
+	dir := withDirectory(t)
+	res := roundTrip(t, "POST /files/nested/dir/file.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\n\r\nnested"+
+		"GET /files/nested/dir/file.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if len(res) != 2 || res[0].status != ResponseCreated || res[1].body != "nested" {
+		t.Fatalf("got %+v, want 201 and then the uploaded body", res)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "nested", "dir")); err != nil || !info.IsDir() {
+		t.Errorf("parent directory not created: %v", err)
+	}
+}
+
+func TestLogSampleZeroLogsOnlyErrors(t *testing.T) {
+	var access bytes.Buffer
+	accessLog = &accessLogger{w: &access}
+	logSample = 0
+	defer func() { accessLog, logSample = nil, 1 }()
+	roundTrip(t, "GET /echo/ok HTTP/1.1\r\nHost: x\r\n\r\nGET /nope HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	lines := strings.Split(strings.TrimSpace(access.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"GET /nope HTTP/1.1" 404`) {
+		t.Errorf("access log %q, want only the 404", access.String())
+	}
+}
+
+func TestDateHeaderUsesClock(t *testing.T) {
+	prev := now
+	now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)) }
+	defer func() { now = prev }()
+	var buf bytes.Buffer
+	res := response{statusCode: ResponseOK}
+	if _, err := res.WriteToConn(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\r\nDate: Tue, 02 Jan 2024 02:04:05 GMT\r\n") {
+		t.Errorf("response %q lacks the Date of the fixed clock in GMT", buf.String())
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	defer func() { serverName = "" }()
+	tests := []struct{ name, want string }{
+		{"codecrafters-http/1.0", "codecrafters-http/1.0"},
+		{"custom/2", "custom/2"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		serverName = tt.name
+		res := roundTrip(t, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if len(res) != 1 {
+			t.Fatalf("got %d responses, want 1", len(res))
+		}
+		if got, ok := res[0].headers["Server"]; tt.want == "" && ok {
+			t.Errorf("-server-name %q: got Server %q, want none", tt.name, got)
+		} else if tt.want != "" && res[0].headers.Get("Server") != tt.want {
+			t.Errorf("-server-name %q: got Server %q, want %q", tt.name, res[0].headers.Get("Server"), tt.want)
+		}
+	}
+}
+
+func TestHeaderNamesCaseInsensitive(t *testing.T) {
+	for _, name := range []string{"user-agent", "USER-AGENT", "uSeR-aGeNt"} {
+		res := roundTrip(t, "GET /user-agent HTTP/1.1\r\nhost: x\r\n"+name+": curl/8\r\nconnection: close\r\n\r\n")
+		if len(res) != 1 || res[0].status != ResponseOK || res[0].body != "curl/8" {
+			t.Errorf("%s: got %+v, want 200 curl/8", name, res)
+		}
+	}
+	req, err := parseRequest("GET / HTTP/1.1\r\nhost: x\r\nx-mixed-CASE: v\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"X-Mixed-Case", "x-mixed-case", "X-MIXED-CASE"} {
+		if got := req.Header(name); got != "v" {
+			t.Errorf("Header(%q) = %q, want v", name, got)
+		}
+	}
+}
+
+func TestChunkedWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	cw := chunkedWriter{w: &buf}
+	parts := []string{"hello", "", ", ", strings.Repeat("x", 5000), "!"}
+	for _, p := range parts {
+		if _, err := io.WriteString(cw, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := readChunkedBody(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(parts, ""); string(body) != want {
+		t.Errorf("decoded %d bytes, want the %d written", len(body), len(want))
+	}
+
+	// A body of unknown length is sent chunked without being asked.
+	var res response
+	responseStream(&res, io.NopCloser(strings.NewReader("streamed")), -1, TypeTextPlain)
+	var wire bytes.Buffer
+	if _, err := res.WriteToConn(&wire); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTestResponse(bufio.NewReader(&wire), false)
+	if err != nil || got.headers.Get("Transfer-Encoding") != "chunked" || got.body != "streamed" {
+		t.Errorf("got %+v, %v, want a chunked \"streamed\"", got, err)
+	}
+}
+
+func TestHTTP10Framing(t *testing.T) {
+	dir := withDirectory(t)
+	content := strings.Repeat("framing ", 200)
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, raw, connection string
+		chunked               bool
+	}{
+		{"1.1 keeps alive by default", "GET /files/f.txt HTTP/1.1\r\nHost: x\r\nAccept-Encoding: gzip\r\n\r\n", "keep-alive", true},
+		{"1.0 closes by default", "GET /files/f.txt HTTP/1.0\r\nAccept-Encoding: gzip\r\n\r\n", "close", false},
+		{"1.0 keep-alive opt-in", "GET /files/f.txt HTTP/1.0\r\nAccept-Encoding: gzip\r\nConnection: keep-alive\r\n\r\n", "keep-alive", false},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		wait := serve(server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go io.WriteString(client, tt.raw)
+		reader := bufio.NewReader(client)
+		status, _ := reader.ReadString('\n')
+		res, err := readTestResponse(bufio.NewReader(io.MultiReader(strings.NewReader(status), reader)), false)
+		client.Close()
+		wait()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		version := strings.Fields(tt.raw)[2]
+		if !strings.HasPrefix(status, version+" 200") {
+			t.Errorf("%s: status line %q, want %s 200", tt.name, status, version)
+		}
+		if got := res.headers.Get("Connection"); got != tt.connection {
+			t.Errorf("%s: Connection %q, want %q", tt.name, got, tt.connection)
+		}
+		if chunked := res.headers.Get("Transfer-Encoding") == "chunked"; chunked != tt.chunked {
+			t.Errorf("%s: chunked %v, want %v", tt.name, chunked, tt.chunked)
+		}
+		if !tt.chunked && res.headers.Get("Content-Length") == "" {
+			t.Errorf("%s: no Content-Length on an HTTP/1.0 response", tt.name)
+		}
+	}
+}
+
+func TestNoFilesBlocksFileRoutes(t *testing.T) {
+	dir := withDirectory(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := router
+	noFiles = true
+	router = setupRouter()
+	defer func() { noFiles, router = false, prev }()
+	res := roundTrip(t, "GET /files/a.txt HTTP/1.1\r\nHost: x\r\n\r\nPOST /files/b.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nConnection: close\r\n\r\nx")
+	if len(res) != 2 {
+		t.Fatalf("got %d responses, want 2", len(res))
+	}
+	for i, r := range res {
+		if r.status != ResponseNotFound || strings.Contains(r.body, "secret") {
+			t.Errorf("response %d: got %d %q, want 404", i+1, r.status, r.body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("POST wrote a file under -no-files: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const TypeEventStream = "text/event-stream"
+
+// minEventInterval keeps ?interval from turning /events into a busy
+// loop.
+const minEventInterval = 10 * time.Millisecond
+
+// handleEvents streams a server-sent event every ?interval (a duration
+// such as "500ms", default 1s) until the client goes away or the server
+// shuts down. A failed write to the client closes the pipe, which stops
+// the generating goroutine.
+func handleEvents(req request, res *response) {
+	interval := time.Second
+	if v := req.Query("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minEventInterval {
+			responseError(req, res, ResponseBadRequest, fmt.Sprintf("interval must be a duration of at least %s", minEventInterval))
+			return
+		}
+		interval = d
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for id := 1; !tracker.closingDown(); id++ {
+			if _, err := fmt.Fprintf(pw, "id: %d\ndata: %s\n\n", id, time.Now().UTC().Format(time.RFC3339)); err != nil {
+				return
+			}
+			<-ticker.C
+		}
+		pw.Close()
+	}()
+	responseStream(res, pr, -1, TypeEventStream)
+	res.SetHeader("Cache-Control", "no-cache")
+	res.flush = true
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+const TypeMessageHTTP = "message/http"
+
+var disableTrace bool
+
+// traceExcluded lists request fields left out of a TRACE reflection
+// because they are likely to carry credentials.
+var traceExcluded = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// handleTrace reflects the received start line and header fields back
+// as a message/http body. The request body is never included, and
+// neither are the continuation lines of a folded excluded field.
+func handleTrace(req request, res *response) {
+	var b strings.Builder
+	excluded := false
+	for _, line := range strings.SplitAfter(req.head, "\r\n") {
+		if line == "" || (line[0] != ' ' && line[0] != '\t') {
+			name, _, _ := strings.Cut(line, ":")
+			excluded = traceExcluded[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))]
+		}
+		if excluded {
+			continue
+		}
+		b.WriteString(line)
+	}
+	responseContent(res, []byte(b.String()), TypeMessageHTTP)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connTracker keeps track of open connections so that shutdown can
+// wake the ones idling between keep-alive requests and wait for the
+// rest to finish their in-flight request.
+type connTracker struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	active  map[net.Conn]bool
+	closing bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{active: make(map[net.Conn]bool)}
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wg.Add(1)
+	t.active[conn] = false
+}
+
+func (t *connTracker) done(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, conn)
+	t.wg.Done()
+}
+
+// setIdle marks conn as waiting for its next request. It reports
+// false once shutdown has begun, in which case the caller should
+// close the connection instead of waiting.
+func (t *connTracker) setIdle(conn net.Conn, idle bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active[conn] = idle
+	return !t.closing
+}
+
+func (t *connTracker) closingDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+// shutdown wakes every idle connection and returns how many
+// connections were open at that point.
+func (t *connTracker) shutdown() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closing = true
+	for conn, idle := range t.active {
+		if idle {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	return len(t.active)
+}
+
+// wait blocks until all connections are done or timeout elapses and
+// reports whether they all finished. A timeout of 0 waits forever.
+func (t *connTracker) wait(timeout time.Duration) bool {
+	drained := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(drained)
+	}()
+	if timeout <= 0 {
+		<-drained
+		return true
+	}
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+// vhostFlag collects repeated -vhost host=/dir flags, keyed by the
+// lower-cased host name.
+type vhostFlag map[string]string
+
+var vhosts = vhostFlag{}
+
+func (v vhostFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for host, dir := range v {
+		pairs = append(pairs, host+"="+dir)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v vhostFlag) Set(value string) error {
+	host, dir, ok := strings.Cut(value, "=")
+	if !ok || host == "" || dir == "" {
+		return errors.New("vhost must be of the form host=/dir")
+	}
+	v[strings.ToLower(host)] = dir
+	return nil
+}
+
+// rootFor returns the directory serving files for the host req was
+// sent to, falling back to -directory for hosts without a -vhost.
+func rootFor(req request) string {
+	if dir, ok := vhosts[hostName(req.host)]; ok {
+		return dir
+	}
+	return directory
+}
+
+// hostName strips the port from a Host header value and lower-cases
+// the rest.
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// websocketGUID is appended to Sec-WebSocket-Key before hashing to
+// derive Sec-WebSocket-Accept (RFC 6455 section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketFrame caps the payload of a single incoming frame.
+const maxWebSocketFrame = 1 << 20
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// handleWebSocket completes the opening handshake for GET /ws and then
+// echoes every text or binary frame back to the client.
+func handleWebSocket(req request, res *response) {
+	if !headerHasToken(req.Header("Upgrade"), "websocket") || !headerHasToken(req.Header("Connection"), "upgrade") {
+		res.statusCode = ResponseUpgradeRequired
+		res.SetHeader("Upgrade", "websocket")
+		return
+	}
+	key := req.Header("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		responseError(req, res, ResponseBadRequest, "invalid Sec-WebSocket-Key")
+		return
+	}
+	if req.Header("Sec-WebSocket-Version") != "13" {
+		res.statusCode = ResponseUpgradeRequired
+		res.SetHeader("Sec-WebSocket-Version", "13")
+		return
+	}
+	res.statusCode = ResponseSwitchingProtocols
+	res.SetHeader("Upgrade", "websocket")
+	res.SetHeader("Connection", "Upgrade")
+	res.SetHeader("Sec-WebSocket-Accept", websocketAccept(key))
+	res.upgrade = echoWebSocket
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma-separated header value
+// contains token, ignoring case.
+func headerHasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// echoWebSocket reads frames until the client closes the connection,
+// writing data frames back unchanged, answering pings with pongs and
+// returning the close frame before stopping.
+func echoWebSocket(r *bufio.Reader, w io.Writer) {
+	for {
+		fin, opcode, payload, err := readFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Println("Error reading WebSocket frame: ", err.Error())
+				writeFrame(w, true, opClose, []byte{0x03, 0xEA})
+			}
+			return
+		}
+		switch opcode {
+		case opContinuation, opText, opBinary:
+			err = writeFrame(w, fin, opcode, payload)
+		case opPing:
+			err = writeFrame(w, true, opPong, payload)
+		case opPong:
+		case opClose:
+			writeFrame(w, true, opClose, payload)
+			return
+		default:
+			writeFrame(w, true, opClose, []byte{0x03, 0xEA})
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readFrame reads one client frame and unmasks its payload. Client
+// frames must be masked.
+func readFrame(r *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked client frame")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketFrame {
+		return false, 0, nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", length, maxWebSocketFrame)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes an unmasked server frame.
+func writeFrame(w io.Writer, fin bool, opcode byte, payload []byte) error {
+	head := []byte{opcode, 0}
+	if fin {
+		head[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xFFFF:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	_, err := w.Write(append(head, payload...))
+	return err
+}